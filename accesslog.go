@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ant0ine/go-json-rest/rest"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////
+// アクセスログ
+//////////////////////////////////////////////////////////////////////////////////////
+
+//redactedParams アクセスログで値を伏せるクエリパラメータ（小文字）
+var redactedParams = map[string]bool{"password": true, "env": true, "sessionid": true, "cert": true, "key": true, "signature": true}
+
+//AccessLogMiddleware 秘密情報を伏せて構造化ログにアクセスログを出力する
+//（TimerMiddlewareとRecorderMiddlewareより外側に置く）
+type AccessLogMiddleware struct{}
+
+//MiddlewareFunc go-json-restのミドルウェア
+func (mw *AccessLogMiddleware) MiddlewareFunc(handler rest.HandlerFunc) rest.HandlerFunc {
+	return func(w rest.ResponseWriter, r *rest.Request) {
+		handler(w, r)
+		kv := []interface{}{
+			"method", r.Method,
+			"uri", RedactURI(r.URL.Path, r.URL.RawQuery),
+			"remote", r.RemoteAddr,
+		}
+		if status, ok := r.Env["STATUS_CODE"].(int); ok {
+			kv = append(kv, "status", status)
+		}
+		if elapsed, ok := r.Env["ELAPSED_TIME"].(*time.Duration); ok && elapsed != nil {
+			kv = append(kv, "elapsed", elapsed.String())
+		}
+		if user, ok := r.Env["REMOTE_USER"].(string); ok && user != "" {
+			kv = append(kv, "user", user)
+		}
+		logger.Info("access", kv...)
+	}
+}
+
+//AccessLogStack rest.DefaultDevStackのアクセスログを秘密情報を伏せるものに置き換えたもの
+func AccessLogStack() []rest.Middleware {
+	return []rest.Middleware{
+		&AccessLogMiddleware{},
+		&rest.TimerMiddleware{},
+		&rest.RecorderMiddleware{},
+		&rest.PoweredByMiddleware{},
+		&rest.RecoverMiddleware{
+			EnableResponseStackTrace: true,
+		},
+		&rest.JsonIndentMiddleware{},
+		&rest.ContentTypeCheckerMiddleware{},
+	}
+}
+
+//RedactURI クエリパラメータの秘密情報を伏せたURI（パラメータの順序は保つ）
+func RedactURI(path string, rawQuery string) string {
+	if rawQuery == "" {
+		return path
+	}
+	params := strings.Split(rawQuery, "&")
+	for i, param := range params {
+		name := param
+		if index := strings.Index(param, "="); index >= 0 {
+			name = param[:index]
+		}
+		decoded, err := url.QueryUnescape(name)
+		if err != nil || redactedParams[strings.ToLower(decoded)] {
+			params[i] = name + "=***"
+		}
+	}
+	return path + "?" + strings.Join(params, "&")
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/ant0ine/go-json-rest/rest"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////
+// エリア一覧
+//////////////////////////////////////////////////////////////////////////////////////
+
+//Area エリアIDと表示名
+type Area struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+//CityAreas 都市ごとのポータルから取得したエリア一覧
+type CityAreas struct {
+	Areas     []Area `json:"areas"`
+	UpdatedAt string `json:"updatedAt"`
+	//Fallback 最後のログインで取得したエリア一覧を使わなかった理由（空でなければ設定の都市のareasを使う）
+	Fallback string `json:"fallback,omitempty"`
+	//Candidate 前回と大きく異なるため保留中のエリア一覧, CandidateCount 続けて同じ一覧を取得した回数
+	Candidate      []Area `json:"candidate,omitempty"`
+	CandidateCount int    `json:"candidateCount,omitempty"`
+}
+
+//AreaAdoptAfter 前回と大きく異なるエリア一覧でも、続けてこの回数だけ同じ一覧を取得したら採用する（エリアの再編に追従するため）
+const AreaAdoptAfter = 3
+
+//AreaCatalog 都市ごとのエリア一覧（ログイン時にポータルから取得し、再起動しても引き継ぐためファイルに保存する）
+type AreaCatalog struct {
+	mu     sync.Mutex
+	path   string
+	Cities map[string]CityAreas `json:"cities"`
+}
+
+//AreasResponse /areasで返す一覧
+type AreasResponse struct {
+	City string `json:"city"`
+	//Source discovered:ポータルから取得, config:設定の都市のareas
+	Source    string `json:"source"`
+	UpdatedAt string `json:"updatedAt,omitempty"`
+	Areas     []Area `json:"areas"`
+	//Fallback ポータルから取得したエリア一覧を使わない理由
+	Fallback string `json:"fallback,omitempty"`
+}
+
+//areaCatalog エリア一覧
+var areaCatalog = NewAreaCatalog(dataPath("AREAS_PATH", "areas.json"))
+
+//NewAreaCatalog ファイルから読み込んで作成する（ファイルがなければ空）
+func NewAreaCatalog(path string) *AreaCatalog {
+	c := &AreaCatalog{path: path, Cities: map[string]CityAreas{}}
+	fp, err := os.Open(path)
+	if err != nil {
+		return c
+	}
+	defer fp.Close()
+	if err := json.NewDecoder(fp).Decode(c); err != nil {
+		logger.Error("area catalog decode failed", "path", path, "error", err)
+		c.Cities = map[string]CityAreas{}
+	}
+	return c
+}
+
+//ParseAreaList ログイン後のページのエリア選択（解析設定のareaOption）からエリア一覧を取得する
+//値が空の選択肢（「選択してください」など）とエリアIDとして不正な値は除く
+func ParseAreaList(doc *goquery.Document) []Area {
+	var areas []Area
+	seen := map[string]bool{}
+	doc.Find(parser.AreaOption).Each(func(i int, s *goquery.Selection) {
+		id, _ := s.Attr("value")
+		id = strings.TrimSpace(id)
+		if !codePattern.MatchString(id) || seen[id] {
+			return
+		}
+		seen[id] = true
+		areas = append(areas, Area{ID: id, Name: strings.TrimSpace(s.Text())})
+	})
+	return areas
+}
+
+//Update 都市のエリア一覧を更新して保存する。前回から変わった場合はログを出力する
+//取得できなかった場合と前回（まだなければ設定の都市のareas）と大きく異なる場合は、前回の一覧を残したまま設定の都市のareasを使う
+func (c *AreaCatalog) Update(lg Logger, city City, areas []Area) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prev, exist := c.Cities[city.Name]
+	last := prev.Areas
+	if !exist || len(last) == 0 {
+		last = configAreas(city)
+	}
+	var fallback string
+	switch {
+	case len(areas) == 0:
+		fallback = "area list not found in login page"
+		prev.Candidate, prev.CandidateCount = nil, 0
+	case len(last) > 0 && areasTooDifferent(last, areas):
+		if sameAreas(prev.Candidate, areas) {
+			prev.CandidateCount++
+		} else {
+			prev.Candidate, prev.CandidateCount = areas, 1
+		}
+		if prev.CandidateCount < AreaAdoptAfter {
+			fallback = "area list too different from last"
+		} else {
+			lg.Warn("area list adopted (same list on consecutive logins)", "city", city.Name, "last", areaIDs(last), "areas", areaIDs(areas), "logins", prev.CandidateCount)
+		}
+	}
+	if fallback != "" {
+		lg.Warn(fallback+", using configured areas", "city", city.Name, "last", areaIDs(last), "areas", areaIDs(areas), "candidate", prev.CandidateCount)
+		prev.Fallback = fallback
+		c.Cities[city.Name] = prev
+		return c.save()
+	}
+	if exist && !sameAreas(prev.Areas, areas) {
+		lg.Info("area list changed", "city", city.Name, "last", areaIDs(prev.Areas), "areas", areaIDs(areas))
+	}
+	c.Cities[city.Name] = CityAreas{Areas: areas, UpdatedAt: time.Now().Format(TimeLayout)}
+	return c.save()
+}
+
+//areasTooDifferent 前回のエリアの半分以上がなくなったか、今回のエリアの半分以上が新しいエリアか
+func areasTooDifferent(last []Area, areas []Area) bool {
+	ids := map[string]bool{}
+	for _, a := range last {
+		ids[a.ID] = true
+	}
+	common := 0
+	for _, a := range areas {
+		if ids[a.ID] {
+			common++
+		}
+	}
+	return common*2 < len(last) || common*2 < len(areas)
+}
+
+//configAreas 設定の都市のareas
+func configAreas(city City) []Area {
+	areas := []Area{}
+	for _, id := range strings.Split(city.Areas, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			areas = append(areas, Area{ID: id})
+		}
+	}
+	return areas
+}
+
+//save ファイルに保存する（一時ファイルからリネームする。ロックは呼び出し元で取る）
+func (c *AreaCatalog) save() error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.path, b)
+}
+
+//Get 都市のエリア一覧を返す。ポータルから取得できていない（使わない）場合は設定の都市のareasを返す
+func (c *AreaCatalog) Get(city City) AreasResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	discovered, exist := c.Cities[city.Name]
+	if exist && len(discovered.Areas) > 0 && discovered.Fallback == "" {
+		return AreasResponse{City: city.Name, Source: "discovered", UpdatedAt: discovered.UpdatedAt, Areas: append([]Area{}, discovered.Areas...)}
+	}
+	return AreasResponse{City: city.Name, Source: "config", Areas: configAreas(city), Fallback: discovered.Fallback}
+}
+
+//AreaIDs 都市の全エリアID（カンマ区切り。areaIDを省略した場合に使う）
+func (c *AreaCatalog) AreaIDs(city City) string {
+	return strings.Join(areaIDs(c.Get(city).Areas), ",")
+}
+
+//areaIDs エリアIDの一覧
+func areaIDs(areas []Area) []string {
+	ids := []string{}
+	for _, a := range areas {
+		ids = append(ids, a.ID)
+	}
+	return ids
+}
+
+//sameAreas エリアIDと表示名が同じか（順序は問わない）
+func sameAreas(a []Area, b []Area) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	key := func(areas []Area) []string {
+		keys := []string{}
+		for _, area := range areas {
+			keys = append(keys, area.ID+"\t"+area.Name)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+	ka, kb := key(a), key(b)
+	for i := range ka {
+		if ka[i] != kb[i] {
+			return false
+		}
+	}
+	return true
+}
+
+//GetAreas 都市のエリア一覧を返す（cityで都市を指定する。省略時はtokyo）
+func GetAreas(w rest.ResponseWriter, r *rest.Request) {
+	city, err := config.City(r.URL.Query().Get("city"))
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteJson(areaCatalog.Get(city))
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ant0ine/go-json-rest/rest"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////
+// 認証
+//////////////////////////////////////////////////////////////////////////////////////
+
+//権限
+const (
+	//PermScrape 台数スクレイピングの実行とスケジュールの有効・無効
+	PermScrape = "scrape"
+	//PermMaster マスタ更新の実行
+	PermMaster = "master"
+	//PermRecover リカバリの実行とスプールの操作
+	PermRecover = "recover"
+	//PermRead 参照のみ
+	PermRead = "read"
+	//PermCredentials 認証情報の更新
+	PermCredentials = "credentials"
+	//PermAll 全ての権限
+	PermAll = "*"
+)
+
+//SignatureMaxSkew 署名付きリクエストの時刻の許容誤差
+const SignatureMaxSkew = 5 * time.Minute
+
+//AuthConfig 認証設定（キーもユーザーもない場合は参照のみ許可する。Disabledの場合は認証しない）
+type AuthConfig struct {
+	Keys  []APIKey    `json:"keys"`
+	Basic []BasicUser `json:"basic"`
+	//Disabled キーもユーザーもない場合に実行・操作系のエンドポイントも認証なしで許可する（明示的に指定した場合のみ）
+	Disabled bool `json:"disabled"`
+}
+
+//APIKey APIキー（X-API-Keyヘッダ、またはHMAC署名で使う）
+type APIKey struct {
+	Name        string   `json:"name"`
+	Key         string   `json:"key"`
+	Permissions []string `json:"permissions"`
+}
+
+//BasicUser ベーシック認証のユーザー
+type BasicUser struct {
+	User        string   `json:"user"`
+	Password    string   `json:"password"`
+	Permissions []string `json:"permissions"`
+}
+
+//SignatureMaxBody 署名付きリクエストで読み込むBodyの上限
+const SignatureMaxBody = 1 << 20
+
+//AuthMiddleware エンドポイントごとに必要な権限を確認するミドルウェア
+type AuthMiddleware struct {
+	Config AuthConfig
+
+	//used 使用済みの署名と有効期限（同じ署名のリクエストを再送されても受け付けない）
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+//Enabled 認証が有効か
+func (c AuthConfig) Enabled() bool {
+	return len(c.Keys) > 0 || len(c.Basic) > 0
+}
+
+//allows 権限を持っているか
+func allows(permissions []string, perm string) bool {
+	for _, p := range permissions {
+		if p == perm || p == PermAll {
+			return true
+		}
+	}
+	return false
+}
+
+//RequiredPermission リクエストに必要な権限（空の場合は認証不要）
+func RequiredPermission(r *rest.Request) string {
+	path := r.URL.Path
+	switch {
+	case path == "/healthz" || path == "/readyz":
+		return ""
+	case path == "/start":
+		return PermScrape
+	case path == "/master":
+		return PermMaster
+	case path == "/recover":
+		return PermRecover
+	case strings.HasPrefix(path, "/credentials"):
+		return PermCredentials
+	case strings.HasPrefix(path, "/jobs/") && strings.HasSuffix(path, "/cancel"):
+		//ジョブの種類を実行する権限でキャンセルできる
+		//存在しないジョブは参照扱いにせず台数スクレイピングの権限とする（認証未設定の場合に許可しないため）
+		if j := jobs.Get(strings.TrimSuffix(strings.TrimPrefix(path, "/jobs/"), "/cancel")); j != nil {
+			return kindPermission(j.Status().Kind)
+		}
+		return PermScrape
+	case strings.HasPrefix(path, "/spool"):
+		//エントリには送信先と送信データ、証明書が含まれるため参照もリカバリの権限とする
+		return PermRecover
+	case strings.HasPrefix(path, "/schedules/") && r.Method != http.MethodGet:
+		return PermScrape
+	}
+	return PermRead
+}
+
+//kindPermission ジョブの種類（counts, master, recover）を実行するのに必要な権限
+func kindPermission(kind string) string {
+	switch kind {
+	case "master":
+		return PermMaster
+	case "recover":
+		return PermRecover
+	}
+	return PermScrape
+}
+
+//MiddlewareFunc go-json-restのミドルウェア
+func (mw *AuthMiddleware) MiddlewareFunc(handler rest.HandlerFunc) rest.HandlerFunc {
+	if !mw.Config.Enabled() {
+		if mw.Config.Disabled {
+			return handler
+		}
+		//認証が設定されていない場合は参照のみ許可する
+		return func(w rest.ResponseWriter, r *rest.Request) {
+			if perm := RequiredPermission(r); perm != "" && perm != PermRead {
+				logger.Warn("request denied (authentication is not configured)", "path", r.URL.Path, "permission", perm)
+				rest.Error(w, "Forbidden (authentication is not configured)", http.StatusForbidden)
+				return
+			}
+			handler(w, r)
+		}
+	}
+	basic := (&rest.AuthBasicMiddleware{
+		Realm:         "heroku-scraper",
+		Authenticator: mw.authenticateBasic,
+		Authorizator: func(user string, r *rest.Request) bool {
+			for _, u := range mw.Config.Basic {
+				if u.User == user {
+					return allows(u.Permissions, RequiredPermission(r))
+				}
+			}
+			return false
+		},
+	}).MiddlewareFunc(handler)
+
+	return func(w rest.ResponseWriter, r *rest.Request) {
+		perm := RequiredPermission(r)
+		if perm == "" {
+			handler(w, r)
+			return
+		}
+		//ベーシック認証はgo-json-restのミドルウェアに任せる
+		if strings.HasPrefix(r.Header.Get("Authorization"), "Basic ") {
+			basic(w, r)
+			return
+		}
+		key, err := mw.authenticateKey(r)
+		if err != nil {
+			logger.Warn("authentication failed", "path", r.URL.Path, "error", err)
+			rest.Error(w, "Not Authorized", http.StatusUnauthorized)
+			return
+		}
+		if !allows(key.Permissions, perm) {
+			logger.Warn("permission denied", "path", r.URL.Path, "key", key.Name, "permission", perm)
+			rest.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		r.Env["REMOTE_USER"] = key.Name
+		handler(w, r)
+	}
+}
+
+//authenticateBasic ベーシック認証のユーザーとパスワードを確認する
+func (mw *AuthMiddleware) authenticateBasic(user string, password string) bool {
+	for _, u := range mw.Config.Basic {
+		if u.User == user && subtle.ConstantTimeCompare([]byte(u.Password), []byte(password)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+//authenticateKey APIキー（X-API-Keyまたはcertヘッダ）またはHMAC署名（X-Key-ID, X-Timestamp, X-Signature）を確認する
+func (mw *AuthMiddleware) authenticateKey(r *rest.Request) (APIKey, error) {
+	if signature := r.Header.Get("X-Signature"); signature != "" {
+		return mw.verifySignature(r, signature)
+	}
+	provided := r.Header.Get("X-API-Key")
+	if provided == "" {
+		provided = r.Header.Get("cert")
+	}
+	if provided == "" {
+		return APIKey{}, fmt.Errorf("no credentials")
+	}
+	for _, key := range mw.Config.Keys {
+		if subtle.ConstantTimeCompare([]byte(key.Key), []byte(provided)) == 1 {
+			return key, nil
+		}
+	}
+	return APIKey{}, fmt.Errorf("unknown api key")
+}
+
+//verifySignature HMAC-SHA256署名を確認する
+func (mw *AuthMiddleware) verifySignature(r *rest.Request, signature string) (APIKey, error) {
+	id := r.Header.Get("X-Key-ID")
+	var key *APIKey
+	for i := range mw.Config.Keys {
+		if mw.Config.Keys[i].Name == id {
+			key = &mw.Config.Keys[i]
+			break
+		}
+	}
+	if key == nil {
+		return APIKey{}, fmt.Errorf("unknown key id : %s", id)
+	}
+	timestamp := r.Header.Get("X-Timestamp")
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return APIKey{}, fmt.Errorf("invalid timestamp")
+	}
+	if skew := time.Since(time.Unix(sec, 0)); skew > SignatureMaxSkew || skew < -SignatureMaxSkew {
+		return APIKey{}, fmt.Errorf("timestamp out of range")
+	}
+	//Bodyも署名に含める（読み込んだ後はハンドラのために戻す）
+	var body []byte
+	if r.Body != nil {
+		if body, err = ioutil.ReadAll(io.LimitReader(r.Body, SignatureMaxBody+1)); err != nil {
+			return APIKey{}, err
+		}
+		if len(body) > SignatureMaxBody {
+			return APIKey{}, fmt.Errorf("body too large")
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	expected := Sign(key.Key, r.Method, r.URL.RequestURI(), timestamp, body)
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(signature))) {
+		return APIKey{}, fmt.Errorf("signature mismatch")
+	}
+	if !mw.useSignature(expected, time.Unix(sec, 0).Add(SignatureMaxSkew)) {
+		return APIKey{}, fmt.Errorf("signature already used")
+	}
+	return *key, nil
+}
+
+//useSignature 署名を使用済みにする。有効期限内に使用済みの場合はfalseを返す
+func (mw *AuthMiddleware) useSignature(signature string, expire time.Time) bool {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	now := time.Now()
+	if mw.used == nil {
+		mw.used = map[string]time.Time{}
+	}
+	for s, e := range mw.used {
+		if now.After(e) {
+			delete(mw.used, s)
+		}
+	}
+	if _, exist := mw.used[signature]; exist {
+		return false
+	}
+	mw.used[signature] = expire
+	return true
+}
+
+//Sign 署名を作成する（"メソッド\nパスとクエリ\nタイムスタンプ\nBodyのSHA-256"のHMAC-SHA256を16進数にしたもの。SHA-256も16進数）
+func Sign(key string, method string, uri string, timestamp string, body []byte) string {
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(method + "\n" + uri + "\n" + timestamp + "\n" + hex.EncodeToString(sum[:])))
+	return hex.EncodeToString(mac.Sum(nil))
+}
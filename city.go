@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////
+// 都市（サービス）
+//////////////////////////////////////////////////////////////////////////////////////
+
+//DefaultCity プロファイルで都市を省略した場合の都市
+const DefaultCity = "tokyo"
+
+//DefaultPortalBaseURL ポータルのURLのサービスコードより前の部分
+const DefaultPortalBaseURL = "https://tcc.docomo-cycle.jp/cycle/"
+
+//PortalBaseURL ポータルのURLのサービスコードより前の部分（環境変数PORTAL_BASE_URLで変更できる）
+var PortalBaseURL = DefaultPortalBaseURL
+
+//City docomo-cycleの都市（サービス）ごとのポータルのパラメータ
+type City struct {
+	//Name 都市名（設定のキー。出力するJSONのcityになる）
+	Name string `json:"-"`
+	//Code サービスコード（ポータルのパスとUserID。東京はTYO）
+	Code string `json:"code"`
+	//EntServiceID スポット一覧のEntServiceID（東京はTYO0001）
+	EntServiceID string `json:"entServiceID"`
+	//MemAreaID ログインのMemAreaID（東京は1）
+	MemAreaID string `json:"memAreaID"`
+	//Areas 全エリアのエリアID（カンマ区切り）
+	Areas string `json:"areas"`
+	//PortalURL ポータルのURL（省略時はPortalBaseURL + Code + "/cs_web_main.php"）
+	PortalURL string `json:"portalURL"`
+}
+
+//builtinCities 設定しなくても使える都市
+func builtinCities() map[string]City {
+	return map[string]City{
+		DefaultCity: {Code: "TYO", EntServiceID: "TYO0001", MemAreaID: "1", Areas: AllSpot},
+	}
+}
+
+//URL ポータルのURL
+func (c City) URL() string {
+	if c.PortalURL != "" {
+		return c.PortalURL
+	}
+	return PortalBaseURL + c.Code + "/cs_web_main.php"
+}
+
+//Validate 必須項目を確認する
+func (c City) Validate() error {
+	if c.Code == "" || c.EntServiceID == "" || c.MemAreaID == "" || c.Areas == "" {
+		return fmt.Errorf("city %s : code, entServiceID, memAreaID and areas are required", c.Name)
+	}
+	for _, areaID := range strings.Split(c.Areas, ",") {
+		if !codePattern.MatchString(areaID) {
+			return fmt.Errorf("city %s : invalid area id : %s", c.Name, areaID)
+		}
+	}
+	return nil
+}
+
+//cityKey 都市ごとに状態を分けるためのキー。既定の都市は従来のキーのまま（保存済みのファイルを引き継ぐため）
+func cityKey(city string, key string) string {
+	if city == "" || city == DefaultCity {
+		return key
+	}
+	return city + ":" + key
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////
+// 設定
+//////////////////////////////////////////////////////////////////////////////////////
+
+//DefaultProfile /startでprofileを省略した場合のプロファイル名
+const DefaultProfile = "default"
+
+//Config 設定（環境変数CONFIG_PATHのJSONファイルを読み込み、環境変数で上書きする）
+type Config struct {
+	//mu プロファイルの排他制御（認証情報は実行中に更新できる）
+	mu sync.RWMutex
+	//APICert 送信時に付ける証明書（環境変数API_CERTで上書き）
+	APICert Secret `json:"apiCert"`
+	//AllowQueryCredentials /startなどでクエリパラメータのid, passwordを受け付けるか（従来の方式）
+	AllowQueryCredentials bool `json:"allowQueryCredentials"`
+	//Profiles プロファイル名ごとのアカウントと送信設定
+	Profiles map[string]Profile `json:"profiles"`
+	//Cities 都市名ごとのポータルのパラメータ（東京は設定しなくても使える。環境変数CITIESの分は追加する）
+	Cities map[string]City `json:"cities"`
+	//Schedules 定期実行スケジュール（環境変数SCHEDULESの分は追加する）
+	Schedules []ScheduleDef `json:"schedules"`
+	//RateLimit 待ち時間と並列数
+	RateLimit RateLimit `json:"rateLimit"`
+	//Auth このサービスのエンドポイントの認証（環境変数AUTH_KEYS, AUTH_BASIC_USERSの分は追加し、AUTH_DISABLEDで無効にする）
+	Auth AuthConfig `json:"auth"`
+	//Parser ポータルのHTMLの解析設定（指定した項目だけ既定値を上書きする。環境変数PARSER_CONFIGも同様）
+	Parser ParserConfig `json:"parser"`
+	//Drift スポット数の急減の検知
+	Drift DriftConfig `json:"drift"`
+}
+
+//Profile アカウントと送信設定（パスワードは"enc:"で始まる暗号化した値でもよい）
+type Profile struct {
+	//City 都市名（省略時はtokyo）
+	City     string `json:"city"`
+	ID       string `json:"id"`
+	Password Secret `json:"password"`
+	Address  string `json:"address"`
+	AreaID   string `json:"areaID"`
+	Sink     string `json:"sink"`
+	Mode     string `json:"mode"`
+	//MasterMode マスタの送信モード（full, changes, both）
+	MasterMode string `json:"masterMode"`
+	//MasterVersion マスタのJSONのバージョン（1, 2）
+	MasterVersion string `json:"masterVersion"`
+	//APICert このプロファイルの送信時に付ける証明書（省略時は全体のapiCert）
+	APICert Secret `json:"apiCert"`
+}
+
+//RateLimit ポータルへの負荷を抑えるための待ち時間と並列数
+type RateLimit struct {
+	//MinInterval 同一アカウントの連続実行とリカバリの最小間隔
+	MinInterval Duration `json:"minInterval"`
+	//PortalRate ポータルへの1秒あたりのリクエスト数（全エリア・全アカウントで共有）
+	PortalRate float64 `json:"portalRate"`
+	//PortalBurst ポータルへ連続で送ってよいリクエスト数
+	PortalBurst int `json:"portalBurst"`
+	//Concurrency 並行して取得するエリア数
+	Concurrency int `json:"concurrency"`
+	//AreaTimeout エリアごとの取得の制限時間
+	AreaTimeout Duration `json:"areaTimeout"`
+	//BatchWait 100件ごとの送信の待ち時間
+	BatchWait Duration `json:"batchWait"`
+}
+
+//Duration "30s"のような文字列または秒数で指定できる時間
+type Duration time.Duration
+
+//config 設定
+var config = NewConfig()
+
+//NewConfig 既定値の設定を作成する
+func NewConfig() *Config {
+	return &Config{
+		Profiles: map[string]Profile{},
+		Cities:   builtinCities(),
+		RateLimit: RateLimit{
+			MinInterval: Duration(2 * time.Minute),
+			PortalRate:  1,
+			PortalBurst: 2,
+			Concurrency: 3,
+			AreaTimeout: Duration(60 * time.Second),
+			BatchWait:   Duration(1 * time.Second),
+		},
+		Parser: DefaultParserConfig(),
+		Drift: DriftConfig{
+			Ratio:      0.5,
+			Window:     10,
+			MinSamples: 3,
+		},
+	}
+}
+
+//UnmarshalJSON 文字列（time.ParseDurationの形式）または秒数を読み込む
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		val, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		*d = Duration(val)
+		return nil
+	}
+	var sec float64
+	if err := json.Unmarshal(b, &sec); err != nil {
+		return fmt.Errorf("invalid duration : %s", string(b))
+	}
+	*d = Duration(sec * float64(time.Second))
+	return nil
+}
+
+//MarshalJSON 文字列で出力する
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+//LoadConfig 設定ファイル（pathが空ならファイルなし）を読み込み、環境変数で上書きする
+func LoadConfig(path string) (*Config, error) {
+	c := NewConfig()
+	if path != "" {
+		fp, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer fp.Close()
+		if err := json.NewDecoder(fp).Decode(c); err != nil {
+			return nil, fmt.Errorf("%s : %v", path, err)
+		}
+		if c.Profiles == nil {
+			c.Profiles = map[string]Profile{}
+		}
+		if c.Cities == nil {
+			c.Cities = builtinCities()
+		}
+	}
+	if err := c.applyEnv(); err != nil {
+		return nil, err
+	}
+	for name, city := range c.Cities {
+		city.Name = name
+		if err := city.Validate(); err != nil {
+			return nil, err
+		}
+		c.Cities[name] = city
+	}
+	if _, err := c.Parser.Compile(); err != nil {
+		return nil, err
+	}
+	//更新済みの認証情報
+	if err := credentials.Apply(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+//applyEnv 環境変数で上書きする
+func (c *Config) applyEnv() error {
+	if val := os.Getenv("API_CERT"); val != "" {
+		c.APICert = NewSecret(val)
+	}
+	if val := os.Getenv("ALLOW_QUERY_CREDENTIALS"); val != "" {
+		allow, err := strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf("ALLOW_QUERY_CREDENTIALS : %v", err)
+		}
+		c.AllowQueryCredentials = allow
+	}
+	//MEMBER_ID, MEMBER_PASSWORD, SEND_ADDRESSはdefaultプロファイルを上書きする
+	prof := c.Profiles[DefaultProfile]
+	overridden := false
+	for env, field := range map[string]*string{"MEMBER_ID": &prof.ID, "SEND_ADDRESS": &prof.Address} {
+		if val := os.Getenv(env); val != "" {
+			*field = val
+			overridden = true
+		}
+	}
+	if val := os.Getenv("MEMBER_PASSWORD"); val != "" {
+		prof.Password = NewSecret(val)
+		overridden = true
+	}
+	if overridden {
+		c.Profiles[DefaultProfile] = prof
+	}
+	for env, field := range map[string]*Duration{"RATE_MIN_INTERVAL": &c.RateLimit.MinInterval, "AREA_TIMEOUT": &c.RateLimit.AreaTimeout, "RATE_BATCH_WAIT": &c.RateLimit.BatchWait} {
+		if val := os.Getenv(env); val != "" {
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return fmt.Errorf("%s : %v", env, err)
+			}
+			*field = Duration(d)
+		}
+	}
+	if val := os.Getenv("PARSER_CONFIG"); val != "" {
+		if err := json.Unmarshal([]byte(val), &c.Parser); err != nil {
+			return fmt.Errorf("PARSER_CONFIG : %v", err)
+		}
+	}
+	if val := os.Getenv("DRIFT_RATIO"); val != "" {
+		ratio, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return fmt.Errorf("DRIFT_RATIO : %v", err)
+		}
+		c.Drift.Ratio = ratio
+	}
+	if val := os.Getenv("ALERT_ADDRESS"); val != "" {
+		c.Drift.AlertAddress = val
+	}
+	if val := os.Getenv("RATE_PORTAL"); val != "" {
+		rate, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return fmt.Errorf("RATE_PORTAL : %v", err)
+		}
+		c.RateLimit.PortalRate = rate
+	}
+	for env, field := range map[string]*int{"RATE_PORTAL_BURST": &c.RateLimit.PortalBurst, "SCRAPE_CONCURRENCY": &c.RateLimit.Concurrency} {
+		if val := os.Getenv(env); val != "" {
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("%s : %v", env, err)
+			}
+			*field = n
+		}
+	}
+	if val := os.Getenv("AUTH_KEYS"); val != "" {
+		var keys []APIKey
+		if err := json.Unmarshal([]byte(val), &keys); err != nil {
+			return fmt.Errorf("AUTH_KEYS : %v", err)
+		}
+		c.Auth.Keys = append(c.Auth.Keys, keys...)
+	}
+	if val := os.Getenv("AUTH_BASIC_USERS"); val != "" {
+		var users []BasicUser
+		if err := json.Unmarshal([]byte(val), &users); err != nil {
+			return fmt.Errorf("AUTH_BASIC_USERS : %v", err)
+		}
+		c.Auth.Basic = append(c.Auth.Basic, users...)
+	}
+	if val := os.Getenv("AUTH_DISABLED"); val != "" {
+		disabled, err := strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf("AUTH_DISABLED : %v", err)
+		}
+		c.Auth.Disabled = disabled
+	}
+	if val := os.Getenv("CITIES"); val != "" {
+		var cities map[string]City
+		if err := json.Unmarshal([]byte(val), &cities); err != nil {
+			return fmt.Errorf("CITIES : %v", err)
+		}
+		for name, city := range cities {
+			c.Cities[name] = city
+		}
+	}
+	//PORTAL_URLは従来どおり東京のポータルのURLを上書きする
+	if val := os.Getenv("PORTAL_URL"); val != "" {
+		city := c.Cities[DefaultCity]
+		city.PortalURL = val
+		c.Cities[DefaultCity] = city
+	}
+	if val := os.Getenv("SCHEDULES"); val != "" {
+		var defs []ScheduleDef
+		if err := json.Unmarshal([]byte(val), &defs); err != nil {
+			return fmt.Errorf("SCHEDULES : %v", err)
+		}
+		c.Schedules = append(c.Schedules, defs...)
+	}
+	return nil
+}
+
+//Profile プロファイル名に対応する設定を返す
+func (c *Config) Profile(name string) (Profile, error) {
+	if name == "" {
+		name = DefaultProfile
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	prof, exist := c.Profiles[name]
+	if !exist {
+		return Profile{}, fmt.Errorf("unknown profile : %s", name)
+	}
+	return prof, nil
+}
+
+//City 都市名に対応する設定を返す（空の場合はtokyo）
+func (c *Config) City(name string) (City, error) {
+	if name == "" {
+		name = DefaultCity
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	city, exist := c.Cities[name]
+	if !exist {
+		return City{}, fmt.Errorf("unknown city : %s", name)
+	}
+	city.Name = name
+	return city, nil
+}
+
+//SetCredentials プロファイルのログインIDとパスワードを更新する（プロファイルがなければ作成する）
+func (c *Config) SetCredentials(name string, id string, password Secret) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prof := c.Profiles[name]
+	prof.ID = id
+	prof.Password = password
+	c.Profiles[name] = prof
+}
+
+//Merge 空の項目をbaseで補った設定を返す
+func (p Profile) Merge(base Profile) Profile {
+	for _, f := range []struct{ field, base *string }{
+		{&p.City, &base.City}, {&p.ID, &base.ID}, {&p.Address, &base.Address}, {&p.AreaID, &base.AreaID},
+		{&p.Sink, &base.Sink}, {&p.Mode, &base.Mode}, {&p.MasterMode, &base.MasterMode},
+		{&p.MasterVersion, &base.MasterVersion},
+	} {
+		if *f.field == "" {
+			*f.field = *f.base
+		}
+	}
+	if p.Password.Empty() {
+		p.Password = base.Password
+	}
+	if p.APICert.Empty() {
+		p.APICert = base.APICert
+	}
+	return p
+}
+
+//RunParam 実行パラメータを作成する（ログインは行わない）。kindはcountsまたはmaster
+func (p Profile) RunParam(kind string) (RunParam, error) {
+	param := RunParam{AreaIdString: p.AreaID, SendAddress: p.Address, Cert: p.APICert}
+	if p.ID == "" || p.Password.Empty() {
+		return param, fmt.Errorf("lack of parameter")
+	}
+	var err error
+	//都市
+	if param.City, err = config.City(p.City); err != nil {
+		return param, err
+	}
+	//マスタの送信モード（full, changes, both）
+	if param.MasterMode, err = MasterModeName(p.MasterMode); err != nil {
+		return param, err
+	}
+	//マスタのJSONのバージョン（1, 2）
+	if param.MasterVersion, err = MasterVersionNumber(p.MasterVersion); err != nil {
+		return param, err
+	}
+	if kind == "master" {
+		//マスタはコールバックURLにのみ送信する
+		if p.Address == "" {
+			return param, fmt.Errorf("lack of parameter")
+		}
+		return param, nil
+	}
+	//出力先
+	if param.Sinks, err = NewSinks(SinkNames(p.Sink), p.Address, p.APICert); err != nil {
+		return param, err
+	}
+	//送信モード（full, delta）
+	if param.Mode, err = ModeName(p.Mode); err != nil {
+		return param, err
+	}
+	return param, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////
+// cron式
+//////////////////////////////////////////////////////////////////////////////////////
+
+//CronSchedule 解析済みのcron式（分 時 日 月 曜日の5フィールド）
+type CronSchedule struct {
+	Expr                          string
+	minute, hour, dom, month, dow map[int]bool
+	//domAny, dowAny 日・曜日が*指定か（両方指定時はどちらかに一致すればよい）
+	domAny, dowAny bool
+}
+
+//ParseCron "*/5 * * * *" 形式のcron式を解析する
+//各フィールドは * 、数値、範囲（a-b）、間隔（*/n, a-b/n）、カンマ区切りに対応する
+func ParseCron(expr string) (*CronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression must have 5 fields : %s", expr)
+	}
+	c := &CronSchedule{Expr: expr}
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	//日曜日は0と7のどちらでもよい
+	if c.dow[7] {
+		c.dow[0] = true
+	}
+	c.domAny = fields[2] == "*"
+	c.dowAny = fields[4] == "*"
+	return c, nil
+}
+
+//parseCronField cron式の1フィールドを解析して該当する値の集合を返す
+func parseCronField(field string, min int, max int) (map[int]bool, error) {
+	result := map[int]bool{}
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			val, err := strconv.Atoi(part[i+1:])
+			if err != nil || val <= 0 {
+				return nil, fmt.Errorf("invalid cron step : %s", field)
+			}
+			step = val
+			part = part[:i]
+		}
+		from, to := min, max
+		if part != "*" {
+			if i := strings.Index(part, "-"); i >= 0 {
+				var err1, err2 error
+				from, err1 = strconv.Atoi(part[:i])
+				to, err2 = strconv.Atoi(part[i+1:])
+				if err1 != nil || err2 != nil {
+					return nil, fmt.Errorf("invalid cron range : %s", field)
+				}
+			} else {
+				val, err := strconv.Atoi(part)
+				if err != nil {
+					return nil, fmt.Errorf("invalid cron value : %s", field)
+				}
+				from = val
+				//"5/10"のような指定は5から最大値まで
+				if step > 1 {
+					to = max
+				} else {
+					to = val
+				}
+			}
+		}
+		if from < min || to > max || from > to {
+			return nil, fmt.Errorf("cron value out of range : %s", field)
+		}
+		for v := from; v <= to; v += step {
+			result[v] = true
+		}
+	}
+	return result, nil
+}
+
+//match 時刻がcron式に一致するか
+func (c *CronSchedule) match(t time.Time) bool {
+	if !c.minute[t.Minute()] || !c.hour[t.Hour()] || !c.month[int(t.Month())] {
+		return false
+	}
+	domMatch := c.dom[t.Day()]
+	dowMatch := c.dow[int(t.Weekday())]
+	if c.domAny || c.dowAny {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+//Next 指定時刻より後で最初に一致する時刻を返す（1年以内に見つからなければゼロ値）
+func (c *CronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(1, 0, 0)
+	for ; t.Before(limit); t = t.Add(time.Minute) {
+		if c.match(t) {
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////
+// スポット数の急減の検知（ポータルのHTMLが変わって解析できなくなったことに気付くため）
+//////////////////////////////////////////////////////////////////////////////////////
+
+//DriftConfig スポット数の急減の検知の設定
+type DriftConfig struct {
+	//Ratio 基準のスポット数に対してこの割合を下回ったら急減とする（0で検知しない）
+	Ratio float64 `json:"ratio"`
+	//Window 基準（中央値）に使う直近の取得回数
+	Window int `json:"window"`
+	//MinSamples 基準に必要な取得回数（これより少ない間は検知しない）
+	MinSamples int `json:"minSamples"`
+	//AlertAddress 急減を検知したときに通知をPOSTするURL（省略時はログ・メトリクス・/readyzのみ）
+	AlertAddress string `json:"alertAddress"`
+}
+
+//DriftAlert 急減の通知
+type DriftAlert struct {
+	Time          string  `json:"time"`
+	City          string  `json:"city"`
+	Area          string  `json:"area"`
+	Spots         int     `json:"spots"`
+	Baseline      int     `json:"baseline"`
+	Ratio         float64 `json:"ratio"`
+	ParserVersion int     `json:"parserVersion"`
+}
+
+//DriftDetector エリアごとの直近のスポット数と急減中のエリア（再起動すると基準を取り直す）
+type DriftDetector struct {
+	mu    sync.Mutex
+	areas map[string]*areaDrift
+}
+
+//areaDrift エリアごとの状態
+type areaDrift struct {
+	samples []int
+	alert   *DriftAlert
+}
+
+//drift スポット数の急減の検知
+var drift = &DriftDetector{areas: map[string]*areaDrift{}}
+
+//Observe エリアのスポット数を記録し、直近の中央値から急減した場合は通知する（急減が続く間は繰り返さない）
+//急減したスポット数も記録するので、実際にスポットが減った場合はいずれ基準が追従する
+//急減中の場合はtrueを返す
+func (d *DriftDetector) Observe(lg Logger, city string, areaID string, spots int) bool {
+	cfg := config.Drift
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key := cityKey(city, areaID)
+	a, exist := d.areas[key]
+	if !exist {
+		a = &areaDrift{}
+		d.areas[key] = a
+	}
+	if len(a.samples) >= cfg.MinSamples && len(a.samples) > 0 && cfg.Ratio > 0 {
+		baseline := median(a.samples)
+		metrics.SpotBaseline.Set(float64(baseline), city, areaID)
+		if baseline > 0 && float64(spots) < float64(baseline)*cfg.Ratio {
+			if a.alert == nil {
+				a.alert = &DriftAlert{Time: time.Now().Format(TimeLayout), City: city, Area: areaID, Spots: spots,
+					Baseline: baseline, Ratio: cfg.Ratio, ParserVersion: parser.Version}
+				lg.Error("spot count drift", "spots", spots, "baseline", baseline, "ratio", cfg.Ratio, "parser_version", parser.Version)
+				metrics.Drifts.Inc(city, areaID)
+				if cfg.AlertAddress != "" {
+					go sendDriftAlert(lg, cfg.AlertAddress, *a.alert)
+				}
+			}
+		} else if a.alert != nil {
+			lg.Info("spot count recovered", "spots", spots, "baseline", baseline, "since", a.alert.Time)
+			a.alert = nil
+		}
+	}
+	a.samples = append(a.samples, spots)
+	if cfg.Window > 0 && len(a.samples) > cfg.Window {
+		a.samples = a.samples[len(a.samples)-cfg.Window:]
+	}
+	return a.alert != nil
+}
+
+//Alerts 急減中のエリアの通知（エリアのキー順）
+func (d *DriftDetector) Alerts() []DriftAlert {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var keys []string
+	for key, a := range d.areas {
+		if a.alert != nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	result := []DriftAlert{}
+	for _, key := range keys {
+		result = append(result, *d.areas[key].alert)
+	}
+	return result
+}
+
+//median 中央値（偶数個の場合は小さい方）
+func median(values []int) int {
+	sorted := append([]int{}, values...)
+	sort.Ints(sorted)
+	return sorted[(len(sorted)-1)/2]
+}
+
+//sendDriftAlert 通知をPOSTする（失敗してもスプールには保存しない）
+func sendDriftAlert(lg Logger, address string, alert DriftAlert) {
+	b, _ := json.Marshal(alert)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", address, bytes.NewReader(b))
+	if err != nil {
+		lg.Error("drift alert failed", "error", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		lg.Error("drift alert failed", "error", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		lg.Error("drift alert failed", "error", fmt.Errorf("status %s", resp.Status))
+		return
+	}
+	lg.Info("drift alert sent", "address", address)
+}
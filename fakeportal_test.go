@@ -0,0 +1,517 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////
+// 疑似ポータル（テスト用）
+//////////////////////////////////////////////////////////////////////////////////////
+
+//FakePortal ログイン（EventNo=21401）とスポット一覧（EventNo=25706）だけを真似たポータル
+type FakePortal struct {
+	//Password 空でなければこのパスワードのみログインできる
+	Password string
+	//ExpireAfter セッションごとにこの回数だけ一覧を返したら期限切れにする（0なら期限切れにしない）
+	ExpireAfter int
+	//Delay スポット一覧の応答を遅らせる時間
+	Delay time.Duration
+	//SpotsPerArea エリアごとのスポット数（1件はメンテナンス中のスポットにする。GetInfoNumより多い場合はページに分ける）
+	SpotsPerArea int
+	//Areas 一覧を返すエリアID（それ以外はエラーページ）
+	Areas map[string]string
+
+	mu       sync.Mutex
+	sessions map[string]int
+	logins   int
+}
+
+//fakeAreaCodes エリアIDとエリアコード
+var fakeAreaCodes = map[string]string{
+	"1": "A1", "2": "B1", "3": "C1", "5": "D1", "6": "E1",
+	"4": "H1", "10": "I1", "12": "J1", "7": "K1", "8": "M1",
+}
+
+//fakeAreaNames エリアIDと表示名（ログイン後のページのエリア選択に出す）
+var fakeAreaNames = map[string]string{
+	"1": "千代田区", "2": "中央区", "3": "港区", "5": "新宿区", "6": "文京区",
+	"4": "江東区", "10": "渋谷区", "12": "品川区", "7": "目黒区", "8": "大田区",
+}
+
+//startFakePortal 疑似ポータルを起動してPortalBaseURLを向ける（止めて戻す関数を返す）
+func startFakePortal(t *testing.T, p *FakePortal) (City, func()) {
+	t.Helper()
+	if p.Areas == nil {
+		p.Areas = fakeAreaCodes
+	}
+	srv := httptest.NewServer(p)
+	old := PortalBaseURL
+	PortalBaseURL = srv.URL + "/cycle/"
+	stop := func() {
+		PortalBaseURL = old
+		srv.Close()
+	}
+	city, err := NewConfig().City("")
+	if err != nil {
+		stop()
+		t.Fatal(err)
+	}
+	return city, stop
+}
+
+//Logins ログインに成功した回数
+func (p *FakePortal) Logins() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.logins
+}
+
+//ServeHTTP EventNoに応じてページを返す
+func (p *FakePortal) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	switch r.Form.Get("EventNo") {
+	case "21401":
+		p.login(w, r)
+	case "25706":
+		if p.Delay > 0 {
+			select {
+			case <-time.After(p.Delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		p.spotList(w, r)
+	default:
+		p.errorPage(w, "不正なリクエストです。")
+	}
+}
+
+//login ログインしてセッションIDを埋め込んだページを返す
+func (p *FakePortal) login(w http.ResponseWriter, r *http.Request) {
+	if r.Form.Get("MemberID") == "" || (p.Password != "" && r.Form.Get("Password") != p.Password) {
+		//ログイン失敗時はSessionIDのないページ
+		fmt.Fprint(w, `<html><body><div class="main_inner_message">会員IDまたはパスワードが違います。</div></body></html>`)
+		return
+	}
+	id := strconv.FormatInt(rand.Int63(), 36)
+	p.mu.Lock()
+	if p.sessions == nil {
+		p.sessions = map[string]int{}
+	}
+	p.sessions[id] = 0
+	p.logins++
+	p.mu.Unlock()
+	//エリア選択はエリアIDの数値順
+	var ids []string
+	for areaID := range p.Areas {
+		ids = append(ids, areaID)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, _ := strconv.Atoi(ids[i])
+		b, _ := strconv.Atoi(ids[j])
+		return a < b
+	})
+	var options strings.Builder
+	options.WriteString(`<option value="">選択してください</option>`)
+	for _, areaID := range ids {
+		name := fakeAreaNames[areaID]
+		if name == "" {
+			name = "エリア" + areaID
+		}
+		fmt.Fprintf(&options, `<option value="%s">%s</option>`, areaID, html.EscapeString(name))
+	}
+	fmt.Fprintf(w, `<html><body><form><input type="hidden" name="SessionID" value="%s"><select name="AreaID">%s</select></form></body></html>`, id, options.String())
+}
+
+//spotList スポット一覧ページを返す（セッション切れ・存在しないエリアはエラーページ）
+//台数はスポットの番号を30で割った余り
+func (p *FakePortal) spotList(w http.ResponseWriter, r *http.Request) {
+	id := r.Form.Get("SessionID")
+	p.mu.Lock()
+	count, exist := p.sessions[id]
+	if exist {
+		count++
+		p.sessions[id] = count
+	}
+	p.mu.Unlock()
+	if !exist || (p.ExpireAfter > 0 && count > p.ExpireAfter) {
+		p.errorPage(w, "セッションの有効期限が切れました。再度ログインしてください。")
+		return
+	}
+	code, exist := p.Areas[r.Form.Get("AreaID")]
+	if !exist {
+		p.errorPage(w, "エリアが見つかりません。")
+		return
+	}
+	//GetInfoTopNum（1から）からGetInfoNum件だけ返す
+	top, err := strconv.Atoi(r.Form.Get("GetInfoTopNum"))
+	if err != nil || top < 1 {
+		top = 1
+	}
+	end := p.SpotsPerArea
+	if num, err := strconv.Atoi(r.Form.Get("GetInfoNum")); err == nil && num > 0 && top-1+num < end {
+		end = top - 1 + num
+	}
+	var b strings.Builder
+	b.WriteString(`<html><body><div class="main_inner">`)
+	for i := top - 1; i < end; i++ {
+		link := fmt.Sprintf("%s-%02d.テストポート%d<br>%s-%02d.Test Port %d<br>%d台", code, i+1, i+1, code, i+1, i+1, (i+1)%30)
+		//最後の1件はメンテナンス中
+		if i == p.SpotsPerArea-1 {
+			link = "メンテナンス中<br>Under maintenance<br>0台"
+		}
+		fmt.Fprintf(&b, `<form name="tab_%d"><input type="hidden" name="ParkingLat" value="35.%04d"><input type="hidden" name="ParkingLon" value="139.%04d"><a>%s</a></form>`,
+			i, 6000+i, 8000+i, link)
+	}
+	b.WriteString(`</div></body></html>`)
+	fmt.Fprint(w, b.String())
+}
+
+//errorPage CheckErrorPageでエラーと判定されるページを返す
+func (p *FakePortal) errorPage(w http.ResponseWriter, message string) {
+	fmt.Fprintf(w, `<html><body><div class="tittle_h1">エラー</div><div class="main_inner_message">%s</div></body></html>`, html.EscapeString(message))
+}
+
+//////////////////////////////////////////////////////////////////////////////////////
+// 疑似ポータルを使ったテスト
+//////////////////////////////////////////////////////////////////////////////////////
+
+func TestLoginFakePortal(t *testing.T) {
+	portal := &FakePortal{Password: "secret", SpotsPerArea: 3}
+	city, stop := startFakePortal(t, portal)
+	defer stop()
+	tests := []struct {
+		name     string
+		password string
+		wantErr  bool
+	}{
+		{name: "ok", password: "secret"},
+		{name: "wrong password", password: "wrong", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session, err := NewSessionManager().Get(context.Background(), logger, city, "member", NewSecret(tt.password))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected login error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if session.ID() == "" {
+				t.Error("session id is empty")
+			}
+		})
+	}
+	//ログイン後のページのエリア選択からエリア一覧を取得している
+	if got := areaCatalog.AreaIDs(city); got != "1,2,3,4,5,6,7,8,10,12" {
+		t.Errorf("discovered areas = %s", got)
+	}
+}
+
+func TestRecordLoginPage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "heroku_scraper_record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer setenv("RECORD_DIR", dir)()
+	portal := &FakePortal{SpotsPerArea: 3}
+	city, stop := startFakePortal(t, portal)
+	defer stop()
+	session, err := NewSessionManager().Get(context.Background(), logger, city, "member", NewSecret("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadFile(filepath.Join(dir, "login.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//セッションIDは保存しない
+	if strings.Contains(string(body), session.ID()) {
+		t.Error("session id recorded")
+	}
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(ParseAreaList(doc)); got != len(fakeAreaCodes) {
+		t.Errorf("areas = %d, want %d", got, len(fakeAreaCodes))
+	}
+}
+
+func TestReadinessWhileLoggingIn(t *testing.T) {
+	portal := &FakePortal{SpotsPerArea: 3}
+	city, stop := startFakePortal(t, portal)
+	defer stop()
+	manager := NewSessionManager()
+	session, err := manager.Get(context.Background(), logger, city, "member", NewSecret("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := sessions
+	sessions = manager
+	defer func() { sessions = old }()
+	//ログインし直している間（セッションのロックを持っている間）も待たずに返す
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	done := make(chan Readiness)
+	go func() { done <- health.Readiness() }()
+	select {
+	case r := <-done:
+		if r.Sessions != 1 {
+			t.Errorf("sessions = %d, want 1", r.Sessions)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("readiness blocked by session lock")
+	}
+}
+
+func TestReloginAfterExpire(t *testing.T) {
+	portal := &FakePortal{ExpireAfter: 1, SpotsPerArea: 5}
+	city, stop := startFakePortal(t, portal)
+	defer stop()
+	ctx := context.Background()
+	session, err := NewSessionManager().Get(ctx, logger, city, "member", NewSecret("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := session.ID()
+	for i := 0; i < 3; i++ {
+		list, _, err := GetSpotInfoMain(ctx, logger, session, "1", true)
+		if err != nil {
+			t.Fatalf("run %d : %v", i, err)
+		}
+		if len(list) != 4 {
+			t.Errorf("run %d : spots = %d, want 4", i, len(list))
+		}
+	}
+	//2回目と3回目はセッション切れでログインし直す
+	if got := portal.Logins(); got != 3 {
+		t.Errorf("logins = %d, want 3", got)
+	}
+	if session.ID() == first {
+		t.Error("session id was not renewed")
+	}
+	//リトライしない場合はセッション切れのエラーを返す
+	if _, _, err := GetSpotInfoMain(ctx, logger, session, "1", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := GetSpotInfoMain(ctx, logger, session, "1", false); err == nil || !strings.Contains(err.Error(), "有効期限") {
+		t.Errorf("error = %v, want session expired", err)
+	}
+}
+
+func TestErrorPageFakePortal(t *testing.T) {
+	portal := &FakePortal{SpotsPerArea: 5}
+	city, stop := startFakePortal(t, portal)
+	defer stop()
+	ctx := context.Background()
+	session, err := NewSessionManager().Get(ctx, logger, city, "member", NewSecret("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//存在しないエリアはログインし直しても同じエラーページなので諦める
+	_, _, err = GetSpotInfoMain(ctx, logger, session, "99", true)
+	if err == nil || err.Error() != "エリアが見つかりません。" {
+		t.Errorf("error = %v", err)
+	}
+	if got := portal.Logins(); got != 2 {
+		t.Errorf("logins = %d, want 2", got)
+	}
+}
+
+func TestMaintenanceSpotsFakePortal(t *testing.T) {
+	tests := []struct {
+		spots     int
+		wantSpots int
+	}{
+		{spots: 1, wantSpots: 0},
+		{spots: 20, wantSpots: 19},
+		//2ページ（最後の1件はメンテナンス中）
+		{spots: SpotPageSize + 30, wantSpots: SpotPageSize + 29},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.spots), func(t *testing.T) {
+			portal := &FakePortal{SpotsPerArea: tt.spots}
+			city, stop := startFakePortal(t, portal)
+			defer stop()
+			ctx := context.Background()
+			session, err := NewSessionManager().Get(ctx, logger, city, "member", NewSecret("password"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			list, invalid, err := GetSpotInfoMain(ctx, logger, session, "4", true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(list) != tt.wantSpots {
+				t.Errorf("spots = %d, want %d", len(list), tt.wantSpots)
+			}
+			//メンテナンス中のスポットは検証エラーにしない
+			if len(invalid) != 0 {
+				t.Errorf("invalid = %v", invalid)
+			}
+			for _, s := range list {
+				if s.Area != "H1" || s.Count != mustAtoi(t, s.Spot)%30 || !s.HasLocation {
+					t.Errorf("unexpected spot %+v", s)
+				}
+			}
+		})
+	}
+}
+
+func TestAreaTimeoutFakePortal(t *testing.T) {
+	portal := &FakePortal{SpotsPerArea: 5, Delay: 500 * time.Millisecond}
+	city, stop := startFakePortal(t, portal)
+	defer stop()
+	old := config.RateLimit
+	config.RateLimit.AreaTimeout = Duration(50 * time.Millisecond)
+	defer func() { config.RateLimit = old }()
+
+	ctx := context.Background()
+	session, err := NewSessionManager().Get(ctx, logger, city, "member", NewSecret("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := jobs.New("counts", "test", "member")
+	p := RunParam{City: city, Session: session, Job: job}
+	called := false
+	started := time.Now()
+	succeeded, err := ScrapeAreas(ctx, logger, p, []string{"1", "2"}, func(ctx context.Context, alg Logger, r AreaScrape) {
+		called = true
+	})
+	if elapsed := time.Since(started); elapsed >= portal.Delay {
+		t.Errorf("areas were not timed out (elapsed %s)", elapsed)
+	}
+	if succeeded != 0 || called {
+		t.Errorf("succeeded = %d, handled = %v", succeeded, called)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error = %v, want deadline exceeded", err)
+	}
+	for _, a := range job.Status().Areas {
+		if a.Error == "" {
+			t.Errorf("area %s has no error", a.AreaID)
+		}
+	}
+}
+
+func TestRegAllSpotInfoFakePortal(t *testing.T) {
+	portal := &FakePortal{SpotsPerArea: 120}
+	city, stop := startFakePortal(t, portal)
+	defer stop()
+	ctx := context.Background()
+	session, err := NewSessionManager().Get(ctx, logger, city, "member", NewSecret("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &recordSink{}
+	job := jobs.New("counts", "test", "member")
+	p := RunParam{City: city, Session: session, AreaIdString: "1,3", Sinks: []Sink{out}, Mode: ModeFull, Job: job}
+	if err := RegAllSpotInfo(job.Context(), p); err != nil {
+		t.Fatal(err)
+	}
+	//2エリア×119件（100件ずつ送信する）
+	if got := out.Count(); got != 238 {
+		t.Errorf("sent = %d, want 238", got)
+	}
+	status := job.Status()
+	if status.State != JobDone || len(status.Areas) != 2 || len(status.Deliveries) != 4 {
+		t.Errorf("job = %+v", status)
+	}
+}
+
+//recordSink 出力されたスポットを記録するシンク
+type recordSink struct {
+	mu   sync.Mutex
+	sent []InnerSpotinfo
+}
+
+//Name シンク名
+func (s *recordSink) Name() string {
+	return "record"
+}
+
+//SendSpotInfo 記録する
+func (s *recordSink) SendSpotInfo(ctx context.Context, lg Logger, jsonStruct JSpotinfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = append(s.sent, jsonStruct.Spotinfo...)
+	return nil
+}
+
+//Count 記録した件数
+func (s *recordSink) Count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sent)
+}
+
+//mustAtoi 数値に変換する
+func mustAtoi(t *testing.T, s string) int {
+	t.Helper()
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestScheduleProfileCert(t *testing.T) {
+	portal := &FakePortal{SpotsPerArea: 3}
+	_, stop := startFakePortal(t, portal)
+	defer stop()
+	var mu sync.Mutex
+	var certs []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		certs = append(certs, r.Header.Get("cert"))
+	}))
+	defer srv.Close()
+
+	config.mu.Lock()
+	config.Profiles["schedule-cert"] = Profile{ID: "schedule-member", Password: NewSecret("password"), Address: srv.URL, AreaID: "1", Sink: "http", APICert: NewSecret("profile")}
+	config.mu.Unlock()
+	defer func() {
+		config.mu.Lock()
+		delete(config.Profiles, "schedule-cert")
+		config.mu.Unlock()
+	}()
+	//スケジュールで直接指定しない項目はプロファイルの設定（証明書を含む）を使う
+	s := &Schedule{ScheduleDef: ScheduleDef{Name: "cert", Kind: "counts", ProfileName: "schedule-cert"}}
+	if err := s.run("test"); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(certs) == 0 {
+		t.Fatal("nothing delivered")
+	}
+	for _, cert := range certs {
+		if cert != "profile" {
+			t.Errorf("cert = %q, want profile", cert)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////
+// 保存ファイル
+//////////////////////////////////////////////////////////////////////////////////////
+
+//dataPath 保存先のパス（環境変数envで指定がなければ一時フォルダのname。Windowsではカレントフォルダ）
+//envが空の場合は環境変数を見ない
+func dataPath(env string, name string) string {
+	if env != "" {
+		if val := os.Getenv(env); val != "" {
+			return val
+		}
+	}
+	if runtime.GOOS != "windows" {
+		return "/tmp/" + name
+	}
+	return name
+}
+
+//writeFileAtomic 同じフォルダの一時ファイルに書いてからリネームする（書きかけのファイルを残さない）
+func writeFileAtomic(path string, data []byte) error {
+	fp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+"-")
+	if err != nil {
+		return err
+	}
+	if _, err := fp.Write(data); err != nil {
+		fp.Close()
+		os.Remove(fp.Name())
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		os.Remove(fp.Name())
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		os.Remove(fp.Name())
+		return err
+	}
+	if err := os.Rename(fp.Name(), path); err != nil {
+		os.Remove(fp.Name())
+		return err
+	}
+	return nil
+}
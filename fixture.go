@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////
+// 記録・リプレイ
+//////////////////////////////////////////////////////////////////////////////////////
+
+//recordDir 記録モードの保存先（環境変数RECORD_DIR、空なら記録しない）
+func recordDir() string {
+	return os.Getenv("RECORD_DIR")
+}
+
+//replayDir リプレイモードの読み込み元（環境変数REPLAY_DIR、空なら通常通りポータルにアクセスする）
+func replayDir() string {
+	return os.Getenv("REPLAY_DIR")
+}
+
+//spotPagePath エリアごとのページファイルのパス（1ページ目は<areaID>.html、2ページ目以降は<areaID>_<page>.html）
+//東京以外は都市ごとのフォルダに分ける
+func spotPagePath(dir string, city City, AreaID string, page int) (string, error) {
+	if !codePattern.MatchString(AreaID) {
+		return "", fmt.Errorf("invalid AreaID : %s", AreaID)
+	}
+	if city.Name != "" && city.Name != DefaultCity {
+		dir = filepath.Join(dir, city.Name)
+	}
+	if page > 1 {
+		return filepath.Join(dir, fmt.Sprintf("%s_%d.html", AreaID, page)), nil
+	}
+	return filepath.Join(dir, AreaID+".html"), nil
+}
+
+//SaveSpotPage ポータルから取得したページをそのまま保存する（エリア・ページごとに最新のみ）
+func SaveSpotPage(city City, AreaID string, page int, body []byte) error {
+	path, err := spotPagePath(recordDir(), city, AreaID, page)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0775); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, body, 0664)
+}
+
+//SaveLoginPage ログイン後のページを<RECORD_DIR>/login.htmlに保存する（セッションIDとログイン情報の値は消す）
+func SaveLoginPage(city City, doc *goquery.Document) error {
+	dir := recordDir()
+	if city.Name != "" && city.Name != DefaultCity {
+		dir = filepath.Join(dir, city.Name)
+	}
+	doc.Find(parser.SessionID).SetAttr("value", "")
+	doc.Find("input[name=MemberID], input[name=Password]").SetAttr("value", "")
+	body, err := goquery.OuterHtml(doc.Selection)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "login.html"), []byte(body), 0664)
+}
+
+//LoadSpotPage 保存済みのページを読み込む（2ページ目以降がない場合はnilを返す）
+func LoadSpotPage(city City, AreaID string, page int) (*goquery.Document, error) {
+	path, err := spotPagePath(replayDir(), city, AreaID, page)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) && page > 1 {
+		return nil, nil
+	}
+	if err != nil {
+		logger.Error("replay page open failed", "area", AreaID, "error", err)
+		return nil, err
+	}
+	defer f.Close()
+	return goquery.NewDocumentFromReader(f)
+}
+
+//wait 負荷緩和のための待ち時間（リプレイモードでは待たない）。キャンセルされた場合はエラーを返す
+func wait(ctx context.Context, d time.Duration) error {
+	if replayDir() != "" {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
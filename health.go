@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ant0ine/go-json-rest/rest"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////
+// ヘルスチェック
+//////////////////////////////////////////////////////////////////////////////////////
+
+//DefaultStaleAfter 最終スクレイピング成功からこの時間を過ぎたら準備未完了とする
+const DefaultStaleAfter = time.Hour
+
+//Health エリアごとの最終成功時刻とポータルの状態
+type Health struct {
+	mu     sync.Mutex
+	areas  map[string]*AreaHealth
+	portal PortalHealth
+}
+
+//AreaHealth エリアごとの状態
+type AreaHealth struct {
+	LastScrape   string `json:"lastScrape,omitempty"`
+	LastDelivery string `json:"lastDelivery,omitempty"`
+	Error        string `json:"error,omitempty"`
+	Stale        bool   `json:"stale"`
+
+	lastScrape time.Time
+}
+
+//PortalHealth ポータルの状態（直近のスクレイピング結果）
+type PortalHealth struct {
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+	Since string `json:"since,omitempty"`
+}
+
+//Readiness /readyzで返す状態
+type Readiness struct {
+	Ready      bool                   `json:"ready"`
+	Reasons    []string               `json:"reasons"`
+	Sessions   int                    `json:"sessions"`
+	Portal     PortalHealth           `json:"portal"`
+	Spool      map[string]int         `json:"spool"`
+	StaleAfter string                 `json:"staleAfter"`
+	Areas      map[string]*AreaHealth `json:"areas"`
+}
+
+//health ヘルスチェック用の状態
+var health = NewHealth()
+
+//NewHealth 作成する
+func NewHealth() *Health {
+	return &Health{areas: map[string]*AreaHealth{}, portal: PortalHealth{State: "unknown"}}
+}
+
+//staleAfter 準備未完了とするまでの時間（環境変数HEALTH_STALE_AFTERで指定する。例："30m"）
+func staleAfter() time.Duration {
+	if val, err := time.ParseDuration(os.Getenv("HEALTH_STALE_AFTER")); err == nil && val > 0 {
+		return val
+	}
+	return DefaultStaleAfter
+}
+
+//area エリアの状態（ロックは呼び出し元で取る）
+func (h *Health) area(areaID string) *AreaHealth {
+	a, exist := h.areas[areaID]
+	if !exist {
+		a = &AreaHealth{}
+		h.areas[areaID] = a
+	}
+	return a
+}
+
+//ObserveScrape エリアのスクレイピング結果を記録する（ポータルの状態も更新する）
+//キャンセルは記録しない。エリアごとの制限時間切れはエリアのエラーとし、ポータルのエラーにはしない（続けば最終成功からの時間で準備未完了になる）
+func (h *Health) ObserveScrape(areaID string, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	a := h.area(areaID)
+	if errors.Is(err, context.DeadlineExceeded) {
+		a.Error = err.Error()
+		return
+	}
+	state := "ok"
+	if err != nil {
+		a.Error = err.Error()
+		state = "error"
+	} else {
+		a.Error = ""
+		a.lastScrape = now
+		a.LastScrape = now.Format(TimeLayout)
+	}
+	if h.portal.State != state {
+		h.portal.Since = now.Format(TimeLayout)
+	}
+	h.portal.State = state
+	h.portal.Error = a.Error
+}
+
+//ObserveDelivery 送信結果を記録する（エリアごとの送信のみ）
+func (h *Health) ObserveDelivery(result DeliveryResult) {
+	if result.AreaID == "" || result.Error != "" {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.area(result.AreaID).LastDelivery = time.Now().Format(TimeLayout)
+}
+
+//Readiness 準備完了かを判定する
+func (h *Health) Readiness() Readiness {
+	//セッション・スプール・急減の状態はh.muを取る前に集める（他のロックを持ったまま待たない）
+	count := sessions.Count()
+	depth := map[string]int{SpoolPending: spool.Depth(SpoolPending), SpoolDead: spool.Depth(SpoolDead)}
+	alerts := drift.Alerts()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	limit := staleAfter()
+	r := Readiness{
+		Reasons:    []string{},
+		Sessions:   count,
+		Portal:     h.portal,
+		Spool:      depth,
+		StaleAfter: limit.String(),
+		Areas:      map[string]*AreaHealth{},
+	}
+	if r.Sessions == 0 {
+		r.Reasons = append(r.Reasons, "no valid session")
+	}
+	if h.portal.State == "error" {
+		r.Reasons = append(r.Reasons, "portal error : "+h.portal.Error)
+	}
+	var stale []string
+	for areaID, a := range h.areas {
+		copied := *a
+		copied.Stale = a.lastScrape.IsZero() || time.Since(a.lastScrape) > limit
+		if copied.Stale {
+			stale = append(stale, areaID)
+		}
+		r.Areas[areaID] = &copied
+	}
+	if len(h.areas) == 0 {
+		r.Reasons = append(r.Reasons, "no scrape yet")
+	}
+	sort.Strings(stale)
+	for _, areaID := range stale {
+		r.Reasons = append(r.Reasons, "stale area : "+areaID)
+	}
+	//スポット数が急減したまま回復していないエリア
+	for _, alert := range alerts {
+		r.Reasons = append(r.Reasons, "spot count drift : "+cityKey(alert.City, alert.Area))
+	}
+	r.Ready = len(r.Reasons) == 0
+	return r
+}
+
+//GetHealthz プロセスが動いていればOKを返す（スクレイピングは行わない）
+func GetHealthz(w rest.ResponseWriter, r *rest.Request) {
+	w.WriteJson(map[string]string{"status": "ok"})
+}
+
+//GetReadyz スクレイピングの状態を返す。準備未完了の場合は503
+func GetReadyz(w rest.ResponseWriter, r *rest.Request) {
+	readiness := health.Readiness()
+	if !readiness.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.WriteJson(readiness)
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ant0ine/go-json-rest/rest"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////
+// ジョブ管理
+//////////////////////////////////////////////////////////////////////////////////////
+
+//MaxJobHistory 保持するジョブ履歴の最大件数
+const MaxJobHistory = 100
+
+//ジョブの状態
+const (
+	JobQueued   = "queued"
+	JobRunning  = "running"
+	JobDone     = "done"
+	JobFailed   = "failed"
+	JobCanceled = "canceled"
+)
+
+//Job 実行ごとのジョブ（/start, /master, /recover, 定期実行）
+type Job struct {
+	mu     sync.Mutex
+	status JobStatus
+	//ctx ジョブのコンテキスト（/jobs/{id}/cancelや終了時にキャンセルされる）
+	ctx    context.Context
+	cancel context.CancelFunc
+	//done 終了時に閉じる
+	done chan struct{}
+}
+
+//JobStatus ジョブの状態（/jobsで返す）
+type JobStatus struct {
+	ID         string           `json:"id"`
+	Kind       string           `json:"kind"`
+	Trigger    string           `json:"trigger"`
+	UserID     string           `json:"userID,omitempty"`
+	State      string           `json:"state"`
+	Error      string           `json:"error,omitempty"`
+	CreatedAt  string           `json:"createdAt"`
+	StartedAt  string           `json:"startedAt,omitempty"`
+	FinishedAt string           `json:"finishedAt,omitempty"`
+	Areas      []AreaResult     `json:"areas"`
+	Deliveries []DeliveryResult `json:"deliveries"`
+	//InvalidSpots 検証エラーで除いたスポットの件数, SpotErrors 検証エラー（MaxSpotErrors件まで）
+	InvalidSpots int         `json:"invalidSpots"`
+	SpotErrors   []SpotError `json:"spotErrors"`
+}
+
+//AreaResult エリアごとのスクレイピング結果
+type AreaResult struct {
+	AreaID string `json:"areaID"`
+	Count  int    `json:"count"`
+	Error  string `json:"error,omitempty"`
+}
+
+//DeliveryResult 送信ごとの結果
+type DeliveryResult struct {
+	AreaID  string `json:"areaID,omitempty"`
+	File    string `json:"file,omitempty"`
+	Sink    string `json:"sink"`
+	Count   int    `json:"count"`
+	Error   string `json:"error,omitempty"`
+	Spooled string `json:"spooled,omitempty"`
+}
+
+//SpooledError 送信に失敗してリカバリ用に保存したことを表すエラー
+type SpooledError struct {
+	Err error
+	ID  string
+}
+
+//Error エラーメッセージ
+func (e *SpooledError) Error() string {
+	return e.Err.Error()
+}
+
+//Unwrap 元のエラー
+func (e *SpooledError) Unwrap() error {
+	return e.Err
+}
+
+//JobManager ジョブ履歴（終了済みの古いものから捨てる）
+type JobManager struct {
+	mu   sync.Mutex
+	jobs []*Job
+	max  int
+	//ctx 全ジョブの親コンテキスト（終了時にキャンセルする）
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+//jobs ジョブ履歴
+var jobs = NewJobManager(MaxJobHistory)
+
+//NewJobManager ジョブ履歴を作成する
+func NewJobManager(max int) *JobManager {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &JobManager{max: max, ctx: ctx, cancel: cancel}
+}
+
+//New ジョブを作成して履歴に加える
+func (m *JobManager) New(kind string, trigger string, userID string) *Job {
+	b := make([]byte, 8)
+	rand.Read(b)
+	j := &Job{status: JobStatus{
+		ID:         hex.EncodeToString(b),
+		Kind:       kind,
+		Trigger:    trigger,
+		UserID:     userID,
+		State:      JobQueued,
+		CreatedAt:  time.Now().Format(TimeLayout),
+		Areas:      []AreaResult{},
+		Deliveries: []DeliveryResult{},
+		SpotErrors: []SpotError{},
+	}, done: make(chan struct{})}
+	j.ctx, j.cancel = context.WithCancel(m.ctx)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.jobs = append(m.jobs, j)
+	m.trim()
+	return j
+}
+
+//trim 最大件数を超えた分を終了済みのジョブの古いものから捨てる（ロックは呼び出し元で取る）
+//待機中・実行中のジョブはキャンセルや終了時の待ち合わせのために残すので、それらが多い間は最大件数を超える
+func (m *JobManager) trim() {
+	over := len(m.jobs) - m.max
+	if over <= 0 {
+		return
+	}
+	kept := m.jobs[:0]
+	for _, j := range m.jobs {
+		if over > 0 && j.Finished() {
+			over--
+			continue
+		}
+		kept = append(kept, j)
+	}
+	for i := len(kept); i < len(m.jobs); i++ {
+		m.jobs[i] = nil
+	}
+	m.jobs = kept
+}
+
+//Get IDでジョブを返す
+func (m *JobManager) Get(id string) *Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, j := range m.jobs {
+		if j.ID() == id {
+			return j
+		}
+	}
+	return nil
+}
+
+//List ジョブの状態を新しい順に返す
+func (m *JobManager) List() []JobStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result := []JobStatus{}
+	for i := len(m.jobs) - 1; i >= 0; i-- {
+		result = append(result, m.jobs[i].Status())
+	}
+	return result
+}
+
+//Shutdown 全ジョブをキャンセルし、終了するまで待つ（ctxの期限まで）。終了しなかったジョブ数を返す
+//以降に作成したジョブは最初からキャンセルされている
+func (m *JobManager) Shutdown(ctx context.Context) int {
+	m.cancel()
+	m.mu.Lock()
+	list := append([]*Job{}, m.jobs...)
+	m.mu.Unlock()
+	remaining := 0
+	for _, j := range list {
+		select {
+		case <-j.done:
+		case <-ctx.Done():
+			remaining++
+		}
+	}
+	return remaining
+}
+
+//ID ジョブID
+func (j *Job) ID() string {
+	if j == nil {
+		return ""
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status.ID
+}
+
+//Logger ジョブID・種類・メンバーIDを付けたロガー
+func (j *Job) Logger() Logger {
+	if j == nil {
+		return logger
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	lg := logger.With("job", j.status.ID, "kind", j.status.Kind)
+	if j.status.UserID != "" {
+		lg = lg.With("member", j.status.UserID)
+	}
+	return lg
+}
+
+//Context ジョブのコンテキスト（ジョブがない場合はキャンセルされないコンテキスト）
+func (j *Job) Context() context.Context {
+	if j == nil {
+		return context.Background()
+	}
+	return j.ctx
+}
+
+//Cancel ジョブをキャンセルする。終了済みの場合はfalseを返す
+func (j *Job) Cancel() bool {
+	if j == nil {
+		return false
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.status.State != JobQueued && j.status.State != JobRunning {
+		return false
+	}
+	j.cancel()
+	return true
+}
+
+//Finished 終了済みか
+func (j *Job) Finished() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status.State != JobQueued && j.status.State != JobRunning
+}
+
+//Start 実行中にする
+func (j *Job) Start() {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status.State = JobRunning
+	j.status.StartedAt = time.Now().Format(TimeLayout)
+}
+
+//Finish 終了状態にする
+func (j *Job) Finish(err error) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.status.State != JobQueued && j.status.State != JobRunning {
+		return
+	}
+	j.status.State = JobDone
+	if err != nil {
+		j.status.State = JobFailed
+		j.status.Error = err.Error()
+	}
+	//キャンセルされた場合は途中までの結果があってもキャンセルとする
+	if j.ctx.Err() == context.Canceled {
+		j.status.State = JobCanceled
+		if err == nil {
+			j.status.Error = context.Canceled.Error()
+		}
+	}
+	j.status.FinishedAt = time.Now().Format(TimeLayout)
+	j.cancel()
+	close(j.done)
+}
+
+//AddArea エリアごとの結果を記録する
+func (j *Job) AddArea(areaID string, count int, err error) {
+	if j == nil {
+		return
+	}
+	result := AreaResult{AreaID: areaID, Count: count}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status.Areas = append(j.status.Areas, result)
+}
+
+//AddSpotErrors スポット情報の検証エラーを記録する（件数はすべて数え、内容はMaxSpotErrors件まで保持する）
+func (j *Job) AddSpotErrors(errs []SpotError) {
+	if j == nil || len(errs) == 0 {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status.InvalidSpots += len(errs)
+	for _, e := range errs {
+		if len(j.status.SpotErrors) >= MaxSpotErrors {
+			break
+		}
+		j.status.SpotErrors = append(j.status.SpotErrors, e)
+	}
+}
+
+//AddDelivery 送信結果を記録する
+func (j *Job) AddDelivery(result DeliveryResult) {
+	metrics.ObserveDelivery(result)
+	health.ObserveDelivery(result)
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status.Deliveries = append(j.status.Deliveries, result)
+}
+
+//Status ジョブの状態のコピーを返す
+func (j *Job) Status() JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	status := j.status
+	status.Areas = append([]AreaResult{}, j.status.Areas...)
+	status.Deliveries = append([]DeliveryResult{}, j.status.Deliveries...)
+	status.SpotErrors = append([]SpotError{}, j.status.SpotErrors...)
+	return status
+}
+
+//NewDeliveryResult 送信結果を作成する（リカバリ用に保存された場合は保存先を記録する）
+func NewDeliveryResult(areaID string, sink string, count int, err error) DeliveryResult {
+	result := DeliveryResult{AreaID: areaID, Sink: sink, Count: count}
+	if err != nil {
+		result.Error = err.Error()
+		var spooled *SpooledError
+		if errors.As(err, &spooled) {
+			result.Spooled = spooled.ID
+		}
+	}
+	return result
+}
+
+//GetJobs ジョブ一覧を返す
+func GetJobs(w rest.ResponseWriter, r *rest.Request) {
+	w.WriteJson(jobs.List())
+}
+
+//GetJob ジョブの状態を返す
+func GetJob(w rest.ResponseWriter, r *rest.Request) {
+	j := jobs.Get(r.PathParam("id"))
+	if j == nil {
+		rest.NotFound(w, r)
+		return
+	}
+	w.WriteJson(j.Status())
+}
+
+//CancelJob 実行中のジョブをキャンセルする（取得済みで未送信のデータはスプールに保存される）
+func CancelJob(w rest.ResponseWriter, r *rest.Request) {
+	j := jobs.Get(r.PathParam("id"))
+	if j == nil {
+		rest.NotFound(w, r)
+		return
+	}
+	if !j.Cancel() {
+		rest.Error(w, "job is already finished", http.StatusConflict)
+		return
+	}
+	j.Logger().Info("job cancel requested")
+	w.WriteJson(map[string]string{"result": "OK", "job": j.ID()})
+}
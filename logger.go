@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////
+// ログ
+//////////////////////////////////////////////////////////////////////////////////////
+
+//ログレベル
+const (
+	LevelDebug = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+//levelNames ログレベル名
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+//secretKeys 値を出力しないキー（パスワードやセッションIDは絶対にログに出さない）
+var secretKeys = map[string]bool{"password": true, "session": true, "sessionid": true, "cert": true, "env": true}
+
+//Logger 構造化ログ。Withで付けたフィールド（job, area, memberなど）を毎行出力する
+type Logger struct {
+	fields []interface{}
+}
+
+//logger ルートのロガー
+var logger = Logger{}
+
+//logOutput ログの出力先
+var logOutput io.Writer = os.Stdout
+
+//logLock 出力の排他制御（行が混ざらないようにする）
+var logLock = sync.Mutex{}
+
+//logLevel 出力するログレベル（環境変数LOG_LEVEL：debug, info, warn, error）
+var logLevel = parseLogLevel(os.Getenv("LOG_LEVEL"))
+
+//logJSON JSONで出力するか（環境変数LOG_FORMAT：json, logfmt）
+var logJSON = os.Getenv("LOG_FORMAT") == "json"
+
+//parseLogLevel ログレベル名を解析する（不明な場合はinfo）
+func parseLogLevel(name string) int {
+	for i, n := range levelNames {
+		if strings.EqualFold(n, name) {
+			return i
+		}
+	}
+	return LevelInfo
+}
+
+//With フィールドを追加したロガーを返す（キーと値を交互に指定する）
+func (l Logger) With(kv ...interface{}) Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return Logger{fields: fields}
+}
+
+//Debug デバッグログ
+func (l Logger) Debug(msg string, kv ...interface{}) {
+	l.output(LevelDebug, msg, kv)
+}
+
+//Info 情報ログ
+func (l Logger) Info(msg string, kv ...interface{}) {
+	l.output(LevelInfo, msg, kv)
+}
+
+//Warn 警告ログ
+func (l Logger) Warn(msg string, kv ...interface{}) {
+	l.output(LevelWarn, msg, kv)
+}
+
+//Error エラーログ
+func (l Logger) Error(msg string, kv ...interface{}) {
+	l.output(LevelError, msg, kv)
+}
+
+//output 1行出力する
+func (l Logger) output(level int, msg string, kv []interface{}) {
+	if level < logLevel {
+		return
+	}
+	keys := []string{"time", "level", "msg"}
+	values := map[string]interface{}{
+		"time":  time.Now().Format(time.RFC3339),
+		"level": levelNames[level],
+		"msg":   msg,
+	}
+	all := append(append([]interface{}{}, l.fields...), kv...)
+	for i := 0; i+1 < len(all); i += 2 {
+		key := fmt.Sprint(all[i])
+		value := all[i+1]
+		if secretKeys[strings.ToLower(key)] {
+			value = "***"
+		}
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		if _, exist := values[key]; !exist {
+			keys = append(keys, key)
+		}
+		values[key] = value
+	}
+
+	var line string
+	if logJSON {
+		b, err := json.Marshal(values)
+		if err != nil {
+			b, _ = json.Marshal(map[string]string{"level": "error", "msg": "log marshal failed", "error": err.Error()})
+		}
+		line = string(b)
+	} else {
+		parts := make([]string, 0, len(keys))
+		for _, key := range keys {
+			parts = append(parts, key+"="+logfmtValue(values[key]))
+		}
+		line = strings.Join(parts, " ")
+	}
+	logLock.Lock()
+	defer logLock.Unlock()
+	fmt.Fprintln(logOutput, line)
+}
+
+//logfmtValue logfmtの値（空白や記号を含む場合は引用符で囲む）
+func logfmtValue(value interface{}) string {
+	s := fmt.Sprint(value)
+	if s == "" || strings.ContainsAny(s, " =\"\t\r\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ant0ine/go-json-rest/rest"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////
+// マスタ差分
+//////////////////////////////////////////////////////////////////////////////////////
+
+//マスタの送信モード
+const (
+	//MasterFull 全件のみ送信する（従来通り）
+	MasterFull = "full"
+	//MasterChanges 変更イベントのみ送信する
+	MasterChanges = "changes"
+	//MasterBoth 全件と変更イベントの両方を送信する
+	MasterBoth = "both"
+)
+
+//マスタのJSONのバージョン
+const (
+	//MasterVersion1 名前は日本語名のみ（従来通り、versionは付けない）
+	MasterVersion1 = 1
+	//MasterVersion2 日本語名・英語名を付け、versionを付ける
+	MasterVersion2 = 2
+)
+
+//変更イベントの種類
+const (
+	ChangeAdded     = "added"
+	ChangeRemoved   = "removed"
+	ChangeRenamed   = "renamed"
+	ChangeRelocated = "relocated"
+)
+
+//MaxMasterChanges 保持する変更イベントの最大件数
+const MaxMasterChanges = 1000
+
+//coordEpsilon 緯度経度の変更とみなす差（誤差は無視する）
+const coordEpsilon = 1e-6
+
+//MasterChange スポットの変更イベント
+type MasterChange struct {
+	Time string           `json:"time"`
+	Type string           `json:"type"`
+	City string           `json:"city"`
+	Area string           `json:"area"`
+	Spot string           `json:"spot"`
+	Old  *InnerSpotmaster `json:"old,omitempty"`
+	New  *InnerSpotmaster `json:"new,omitempty"`
+}
+
+//JMasterChanges JSONマーシャリング構造体
+type JMasterChanges struct {
+	Version       int            `json:"version,omitempty"`
+	Masterchanges []MasterChange `json:"masterchanges"`
+}
+
+//MasterState 前回のマスタと変更イベント履歴（再起動しても引き継ぐためファイルに保存する）
+type MasterState struct {
+	mu   sync.Mutex
+	path string
+	//Areas エリアIDごと（東京以外は"都市:エリアID"）、"エリア-スポット"ごとのマスタ
+	Areas   map[string]map[string]InnerSpotmaster `json:"areas"`
+	Changes []MasterChange                        `json:"changes"`
+}
+
+//masterState 前回のマスタ
+var masterState = NewMasterState(dataPath("MASTER_STATE_PATH", "master.json"))
+
+//NewMasterState ファイルから読み込んで作成する（ファイルがなければ空）
+func NewMasterState(path string) *MasterState {
+	m := &MasterState{path: path, Areas: map[string]map[string]InnerSpotmaster{}}
+	fp, err := os.Open(path)
+	if err != nil {
+		return m
+	}
+	defer fp.Close()
+	if err := json.NewDecoder(fp).Decode(m); err != nil {
+		logger.Error("master state decode failed", "path", path, "error", err)
+		m.Areas = map[string]map[string]InnerSpotmaster{}
+		m.Changes = nil
+	}
+	return m
+}
+
+//MasterVersionNumber マスタのJSONのバージョンの指定（省略時は1）
+func MasterVersionNumber(version string) (int, error) {
+	switch version {
+	case "", "1":
+		return MasterVersion1, nil
+	case "2":
+		return MasterVersion2, nil
+	}
+	return 0, fmt.Errorf("unknown master version : %s", version)
+}
+
+//NewJSpotmaster バージョンを指定してマスタのJSONを作成する
+func NewJSpotmaster(version int) JSpotmaster {
+	if version < MasterVersion2 {
+		return JSpotmaster{}
+	}
+	return JSpotmaster{Version: version}
+}
+
+//NewJMasterChanges 変更イベントをバージョンに合わせたJSONにする
+func NewJMasterChanges(version int, changes []MasterChange) JMasterChanges {
+	result := JMasterChanges{}
+	if version >= MasterVersion2 {
+		result.Version = version
+	}
+	for _, c := range changes {
+		if c.Old != nil {
+			old := c.Old.Versioned(version)
+			c.Old = &old
+		}
+		if c.New != nil {
+			cur := c.New.Versioned(version)
+			c.New = &cur
+		}
+		result.Masterchanges = append(result.Masterchanges, c)
+	}
+	return result
+}
+
+//MarshalJSON 英語名の出所がある場合（バージョン2）は英語名が空でもnameEnを出力する
+func (m InnerSpotmaster) MarshalJSON() ([]byte, error) {
+	type plain InnerSpotmaster
+	if m.NameEnSource == "" {
+		return json.Marshal(plain(m))
+	}
+	return json.Marshal(struct {
+		plain
+		NameEn       string `json:"nameEn"`
+		NameEnSource string `json:"nameEnSource"`
+	}{plain(m), m.NameEn, m.NameEnSource})
+}
+
+//Versioned バージョンに合わせた項目にする（バージョン1では日本語名・英語名を除く）
+func (m InnerSpotmaster) Versioned(version int) InnerSpotmaster {
+	if version < MasterVersion2 {
+		m.NameJa, m.NameEn, m.NameEnSource = "", "", ""
+	}
+	return m
+}
+
+//MasterModeName マスタの送信モードの指定（省略時はfull）
+func MasterModeName(mode string) (string, error) {
+	switch mode {
+	case "":
+		return MasterFull, nil
+	case MasterFull, MasterChanges, MasterBoth:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown master mode : %s", mode)
+}
+
+//Diff エリアのスクレイピング結果を前回のマスタと比較して変更イベントを返し、前回のマスタを更新する
+//前回のマスタがないエリアは基準として記録するだけで変更イベントは出さない
+//invalid（検証エラーで除いたスポット）は削除とせず前回のマスタのまま残す。スポットコードが分からない検証エラーがある場合は削除を判定しない
+func (m *MasterState) Diff(city string, areaID string, list []SpotInfo, invalid []SpotError) []MasterChange {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	current := map[string]InnerSpotmaster{}
+	for _, s := range list {
+		cur := s.InnerMaster()
+		cur.City = city
+		current[s.Code()] = cur
+	}
+	rejected := map[string]bool{}
+	unknown := false
+	for _, e := range invalid {
+		if e.Area == "" || e.Spot == "" {
+			unknown = true
+			continue
+		}
+		rejected[SpotCode{Area: e.Area, Spot: e.Spot}.Code()] = true
+	}
+	key := cityKey(city, areaID)
+	previous, exist := m.Areas[key]
+	m.Areas[key] = current
+	if !exist {
+		return nil
+	}
+
+	now := time.Now().Format(TimeLayout)
+	var changes []MasterChange
+	for code, cur := range current {
+		cur := cur
+		old, exist := previous[code]
+		if !exist {
+			changes = append(changes, MasterChange{Time: now, Type: ChangeAdded, City: city, Area: cur.Area, Spot: cur.Spot, New: &cur})
+			continue
+		}
+		//今回緯度経度を取得できなかった場合は前回の緯度経度を残す（移動とはしない）
+		if !hasCoord(cur) && hasCoord(old) {
+			cur.Lat, cur.Lon = old.Lat, old.Lon
+			current[code] = cur
+		}
+		//英語名は前回のマスタに出所がある場合のみ比較する（英語名を記録する前のマスタと比べて全件変更にしないため）
+		if old.Name != cur.Name || (old.NameEnSource != "" && old.NameEn != cur.NameEn) {
+			changes = append(changes, MasterChange{Time: now, Type: ChangeRenamed, City: city, Area: cur.Area, Spot: cur.Spot, Old: &old, New: &cur})
+		}
+		//緯度経度は前回・今回とも取得できた場合のみ比較する
+		if hasCoord(old) && hasCoord(cur) && (!sameCoord(old.Lat, cur.Lat) || !sameCoord(old.Lon, cur.Lon)) {
+			changes = append(changes, MasterChange{Time: now, Type: ChangeRelocated, City: city, Area: cur.Area, Spot: cur.Spot, Old: &old, New: &cur})
+		}
+	}
+	for code, old := range previous {
+		old := old
+		if _, exist := current[code]; exist {
+			continue
+		}
+		if unknown || rejected[code] {
+			current[code] = old
+			continue
+		}
+		changes = append(changes, MasterChange{Time: now, Type: ChangeRemoved, City: city, Area: old.Area, Spot: old.Spot, Old: &old})
+	}
+
+	//履歴に追加（古いものから捨てる）
+	m.Changes = append(m.Changes, changes...)
+	if len(m.Changes) > MaxMasterChanges {
+		m.Changes = m.Changes[len(m.Changes)-MaxMasterChanges:]
+	}
+	return changes
+}
+
+//hasCoord 緯度経度があるか
+func hasCoord(m InnerSpotmaster) bool {
+	return m.Lat != "" && m.Lon != ""
+}
+
+//sameCoord 緯度経度が同じか（数値にできない場合は文字列で比較する）
+func sameCoord(a string, b string) bool {
+	fa, errA := strconv.ParseFloat(a, 64)
+	fb, errB := strconv.ParseFloat(b, 64)
+	if errA != nil || errB != nil {
+		return a == b
+	}
+	return math.Abs(fa-fb) < coordEpsilon
+}
+
+//Since 指定時刻以降の変更イベントを返す
+func (m *MasterState) Since(since time.Time) []MasterChange {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result := []MasterChange{}
+	for _, c := range m.Changes {
+		if t, err := time.ParseInLocation(TimeLayout, c.Time, time.Local); err == nil && t.Before(since) {
+			continue
+		}
+		result = append(result, c)
+	}
+	return result
+}
+
+//Save ファイルに保存する（一時ファイルからリネームする）
+func (m *MasterState) Save() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(m.path, b)
+}
+
+//SendMasterChanges マスタの変更イベントをDBに送信する。リカバリからの場合は失敗したらJSONを保存しないフラグ（第３引数）
+//保存した場合はSpooledErrorを返す
+func SendMasterChanges(ctx context.Context, lg Logger, address string, cert Secret, jsonStruct JMasterChanges, fromRecovery bool) error {
+	return postJSON(ctx, lg, "SendMasterChanges", SpoolTypeMasterchanges, address, cert, jsonStruct, fromRecovery)
+}
+
+//GetMasterChanges マスタの変更イベントを返す（sinceで絞り込み）
+func GetMasterChanges(w rest.ResponseWriter, r *rest.Request) {
+	var since time.Time
+	if val := r.URL.Query().Get("since"); val != "" {
+		t, err := ParseQueryTime(val)
+		if err != nil {
+			rest.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		since = t
+	}
+	w.WriteJson(JMasterChanges{Masterchanges: masterState.Since(since)})
+}
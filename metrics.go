@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ant0ine/go-json-rest/rest"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////
+// メトリクス（Prometheusのテキスト形式）
+//////////////////////////////////////////////////////////////////////////////////////
+
+//MetricPrefix メトリクス名の接頭辞
+const MetricPrefix = "heroku_scraper_"
+
+//durationBuckets スクレイピング時間のヒストグラムの区切り（秒）
+var durationBuckets = []float64{0.5, 1, 2, 5, 10, 20, 30, 60}
+
+//metricVec ラベルごとの値を持つカウンタまたはゲージ
+type metricVec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+//histogramVec ラベルごとのヒストグラム
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	counts  map[string][]uint64
+	sums    map[string]float64
+	totals  map[string]uint64
+}
+
+//Metrics アプリケーション全体のメトリクス
+type Metrics struct {
+	Logins         *metricVec
+	Relogins       *metricVec
+	Scrapes        *metricVec
+	ScrapeDuration *histogramVec
+	SpotsParsed    *metricVec
+	SpotsSkipped   *metricVec
+	SpotPages      *metricVec
+	PageAnomalies  *metricVec
+	SpotBaseline   *metricVec
+	Drifts         *metricVec
+	Deliveries     *metricVec
+	Spooled        *metricVec
+	LastSuccess    *metricVec
+}
+
+//metrics メトリクス
+var metrics = NewMetrics()
+
+//NewMetrics メトリクスを作成する
+func NewMetrics() *Metrics {
+	return &Metrics{
+		Logins:         newMetricVec("logins_total", "Portal logins by result.", "counter", "result"),
+		Relogins:       newMetricVec("relogins_total", "Relogins forced by the portal error page.", "counter"),
+		Scrapes:        newMetricVec("scrapes_total", "Spot list scrapes by city, area and result.", "counter", "city", "area", "result"),
+		ScrapeDuration: newHistogramVec("scrape_duration_seconds", "Time to fetch and parse the spot list of an area.", durationBuckets, "city", "area"),
+		SpotsParsed:    newMetricVec("spots_parsed_total", "Spots parsed from the spot list by city and area.", "counter", "city", "area"),
+		SpotsSkipped:   newMetricVec("spots_skipped_total", "Spots rejected by the parser by reason.", "counter", "reason"),
+		SpotPages:      newMetricVec("spot_pages", "Spot list pages fetched in the last scrape by city and area.", "gauge", "city", "area"),
+		PageAnomalies:  newMetricVec("spot_page_anomalies_total", "Unexpected spot list paging by city, area and reason (changed, oversized, repeated, limit).", "counter", "city", "area", "reason"),
+		SpotBaseline:   newMetricVec("spot_count_baseline", "Median spot count of recent scrapes by city and area.", "gauge", "city", "area"),
+		Drifts:         newMetricVec("spot_count_drifts_total", "Sudden drops of the spot count below the baseline by city and area.", "counter", "city", "area"),
+		Deliveries:     newMetricVec("deliveries_total", "Delivery attempts by sink and result.", "counter", "sink", "result"),
+		Spooled:        newMetricVec("spooled_batches_total", "Batches saved to the spool after a delivery failure by data type.", "counter", "type"),
+		LastSuccess:    newMetricVec("last_success_timestamp_seconds", "Unix time of the last success by operation.", "gauge", "operation"),
+	}
+}
+
+//newMetricVec カウンタまたはゲージを作成する
+func newMetricVec(name string, help string, kind string, labels ...string) *metricVec {
+	return &metricVec{name: MetricPrefix + name, help: help, kind: kind, labels: labels, values: map[string]float64{}}
+}
+
+//newHistogramVec ヒストグラムを作成する
+func newHistogramVec(name string, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: MetricPrefix + name, help: help, labels: labels, buckets: buckets,
+		counts: map[string][]uint64{}, sums: map[string]float64{}, totals: map[string]uint64{}}
+}
+
+//Inc 1加算する（ラベルの値は定義順に指定する）
+func (m *metricVec) Inc(values ...string) {
+	m.Add(1, values...)
+}
+
+//Add 加算する
+func (m *metricVec) Add(v float64, values ...string) {
+	key := labelString(m.labels, values)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[key] += v
+}
+
+//Set 値を設定する
+func (m *metricVec) Set(v float64, values ...string) {
+	key := labelString(m.labels, values)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[key] = v
+}
+
+//SetToNow 現在時刻（Unix時間）を設定する
+func (m *metricVec) SetToNow(values ...string) {
+	m.Set(float64(time.Now().UnixNano())/1e9, values...)
+}
+
+//write テキスト形式で出力する
+func (m *metricVec) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	for _, key := range sortedKeys(m.values) {
+		fmt.Fprintf(w, "%s%s %s\n", m.name, key, formatFloat(m.values[key]))
+	}
+}
+
+//Observe 値を記録する
+func (h *histogramVec) Observe(v float64, values ...string) {
+	key := labelString(h.labels, values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	counts, exist := h.counts[key]
+	if !exist {
+		counts = make([]uint64, len(h.buckets))
+		h.counts[key] = counts
+	}
+	for i, le := range h.buckets {
+		if v <= le {
+			counts[i]++
+		}
+	}
+	h.sums[key] += v
+	h.totals[key]++
+}
+
+//write テキスト形式で出力する
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.counts))
+	for key := range h.counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for i, le := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, withLabel(key, "le", formatFloat(le)), h.counts[key][i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, withLabel(key, "le", "+Inf"), h.totals[key])
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, key, formatFloat(h.sums[key]))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, key, h.totals[key])
+	}
+}
+
+//labelString ラベルを{name="value",...}の形式にする
+func labelString(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	parts := make([]string, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		parts[i] = name + `="` + escapeLabel(value) + `"`
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+//withLabel ラベル文字列にラベルを追加する
+func withLabel(key string, name string, value string) string {
+	label := name + `="` + escapeLabel(value) + `"`
+	if key == "" {
+		return "{" + label + "}"
+	}
+	return key[:len(key)-1] + "," + label + "}"
+}
+
+//escapeLabel ラベル値のエスケープ
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+//formatFloat 数値の出力形式
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+//sortedKeys キーをソートして返す
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//ObserveScrape エリアのスクレイピング結果を記録する
+func (m *Metrics) ObserveScrape(city string, areaID string, elapsed time.Duration, count int, err error) {
+	m.ScrapeDuration.Observe(elapsed.Seconds(), city, areaID)
+	if err != nil {
+		m.Scrapes.Inc(city, areaID, "failure")
+		return
+	}
+	m.Scrapes.Inc(city, areaID, "success")
+	m.SpotsParsed.Add(float64(count), city, areaID)
+	m.LastSuccess.SetToNow("scrape")
+}
+
+//ObserveDelivery 送信結果を記録する
+func (m *Metrics) ObserveDelivery(result DeliveryResult) {
+	switch {
+	case result.Spooled != "":
+		m.Deliveries.Inc(result.Sink, "spooled")
+	case result.Error != "":
+		m.Deliveries.Inc(result.Sink, "failure")
+	default:
+		m.Deliveries.Inc(result.Sink, "success")
+		m.LastSuccess.SetToNow("delivery")
+	}
+}
+
+//Write 全メトリクスをテキスト形式で出力する（スプールのエントリ数は出力時に数える）
+func (m *Metrics) Write(w io.Writer) {
+	m.Logins.write(w)
+	m.Relogins.write(w)
+	m.Scrapes.write(w)
+	m.ScrapeDuration.write(w)
+	m.SpotsParsed.write(w)
+	m.SpotsSkipped.write(w)
+	m.SpotPages.write(w)
+	m.PageAnomalies.write(w)
+	m.SpotBaseline.write(w)
+	m.Drifts.write(w)
+	m.Deliveries.write(w)
+	m.Spooled.write(w)
+	m.LastSuccess.write(w)
+	depth := newMetricVec("spool_entries", "Entries in the spool by state.", "gauge", "state")
+	depth.Set(float64(spool.Depth(SpoolPending)), SpoolPending)
+	depth.Set(float64(spool.Depth(SpoolDead)), SpoolDead)
+	depth.write(w)
+}
+
+//GetMetrics メトリクスを返す
+func GetMetrics(w rest.ResponseWriter, r *rest.Request) {
+	var b bytes.Buffer
+	metrics.Write(&b)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.(http.ResponseWriter).Write(b.Bytes())
+}
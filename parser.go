@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////
+// ポータルのHTMLの解析設定
+//////////////////////////////////////////////////////////////////////////////////////
+
+//ParserVersion このバージョンで解釈できる解析設定のバージョン
+const ParserVersion = 1
+
+//ParserConfig ポータルのHTMLのセレクタとテキストのパターン（ポータルの変更に設定で追従できるようにする）
+//設定ファイルのparserまたは環境変数PARSER_CONFIGで指定した項目だけ既定値を上書きする
+type ParserConfig struct {
+	//Version 解析設定のバージョン（ParserVersionまで）
+	Version int `json:"version"`
+	//SpotEntry スポット一覧の1スポット分の要素
+	SpotEntry string `json:"spotEntry"`
+	//SpotText スポット名・台数のテキストの要素（SpotEntryの中）
+	SpotText string `json:"spotText"`
+	//Lat, Lon 緯度・経度のinput要素（SpotEntryの中、value属性）
+	Lat string `json:"lat"`
+	Lon string `json:"lon"`
+	//SessionID ログイン後のページのセッションIDのinput要素
+	SessionID string `json:"sessionID"`
+	//AreaOption ログイン後のページのエリア選択の選択肢
+	AreaOption string `json:"areaOption"`
+	//ErrorTitle, ErrorMessage エラーページのタイトルとメッセージの要素
+	ErrorTitle   string `json:"errorTitle"`
+	ErrorMessage string `json:"errorMessage"`
+	//ErrorKeyword タイトルにこの文字列を含む場合はエラーページ
+	ErrorKeyword string `json:"errorKeyword"`
+	//LineBreak スポットのテキストの行の区切り（正規表現）
+	LineBreak string `json:"lineBreak"`
+	//SpotLine 1行目（"H1-43.東京イースト21"）の正規表現。エリア・スポット・名前の順にグループにする
+	SpotLine string `json:"spotLine"`
+	//EnglishLine 2行目（"H1-43.Tokyo East 21"）の正規表現。英語名をグループにする
+	EnglishLine string `json:"englishLine"`
+	//CountLine 最後の行（"13台"）の正規表現。台数をグループにする
+	CountLine string `json:"countLine"`
+	//MaintenanceLine 1行目がこの正規表現に一致する場合はメンテナンス中のスポット
+	MaintenanceLine string `json:"maintenanceLine"`
+}
+
+//DefaultParserConfig 既定の解析設定（2020年時点のポータル）
+func DefaultParserConfig() ParserConfig {
+	return ParserConfig{
+		Version:         ParserVersion,
+		SpotEntry:       "form[name^=tab_]",
+		SpotText:        "a",
+		Lat:             "input[name=ParkingLat]",
+		Lon:             "input[name=ParkingLon]",
+		SessionID:       "input[name='SessionID']",
+		AreaOption:      "select[name=AreaID] option",
+		ErrorTitle:      ".tittle_h1",
+		ErrorMessage:    ".main_inner_message",
+		ErrorKeyword:    "エラー",
+		LineBreak:       `(?i)<br\s*/?>|\r?\n`,
+		SpotLine:        `^([0-9A-Za-z]+)\s*-\s*([0-9A-Za-z]+)\s*\.\s*(.*)$`,
+		EnglishLine:     `^[0-9A-Za-z]+\s*-\s*[0-9A-Za-z]+\s*\.\s*(.*)$`,
+		CountLine:       `^([0-9]+)\s*台$`,
+		MaintenanceLine: `^[^.]*$`,
+	}
+}
+
+//Parser 解析設定の正規表現をコンパイルしたもの
+type Parser struct {
+	ParserConfig
+	lineBreak       *regexp.Regexp
+	spotLine        *regexp.Regexp
+	englishLine     *regexp.Regexp
+	countLine       *regexp.Regexp
+	maintenanceLine *regexp.Regexp
+}
+
+//parser ポータルのHTMLの解析（起動時に設定から作り直す）
+var parser = mustParser(DefaultParserConfig())
+
+//mustParser 既定の解析設定用（コンパイルできない場合はpanic）
+func mustParser(c ParserConfig) *Parser {
+	p, err := c.Compile()
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+//Compile バージョンと正規表現を確認してコンパイルする
+func (c ParserConfig) Compile() (*Parser, error) {
+	if c.Version < 1 || c.Version > ParserVersion {
+		return nil, fmt.Errorf("parser : unsupported version %d (supported up to %d)", c.Version, ParserVersion)
+	}
+	for name, selector := range map[string]string{
+		"spotEntry": c.SpotEntry, "spotText": c.SpotText, "lat": c.Lat, "lon": c.Lon, "sessionID": c.SessionID,
+		"areaOption": c.AreaOption, "errorTitle": c.ErrorTitle, "errorMessage": c.ErrorMessage, "errorKeyword": c.ErrorKeyword,
+	} {
+		if strings.TrimSpace(selector) == "" {
+			return nil, fmt.Errorf("parser : %s is empty", name)
+		}
+	}
+	p := &Parser{ParserConfig: c}
+	for _, re := range []struct {
+		name    string
+		pattern string
+		groups  int
+		target  **regexp.Regexp
+	}{
+		{"lineBreak", c.LineBreak, 0, &p.lineBreak},
+		{"spotLine", c.SpotLine, 3, &p.spotLine},
+		{"englishLine", c.EnglishLine, 1, &p.englishLine},
+		{"countLine", c.CountLine, 1, &p.countLine},
+		{"maintenanceLine", c.MaintenanceLine, 0, &p.maintenanceLine},
+	} {
+		compiled, err := regexp.Compile(re.pattern)
+		if err != nil {
+			return nil, fmt.Errorf("parser : %s : %v", re.name, err)
+		}
+		if compiled.NumSubexp() < re.groups {
+			return nil, fmt.Errorf("parser : %s needs %d groups", re.name, re.groups)
+		}
+		*re.target = compiled
+	}
+	return p, nil
+}
+
+//Lines スポットのテキスト（要素の中のHTML）を行に分ける
+//<br>、<br/>、<br />と改行のどれで区切られていてもよく、文字参照は戻し、前後の空白（全角・&nbsp;を含む）と空行は除く
+func (p *Parser) Lines(text string) []string {
+	var lines []string
+	for _, line := range p.lineBreak.Split(text, -1) {
+		line = strings.TrimSpace(html.UnescapeString(line))
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+//ParseSpotText スポットのテキストからエリア・スポット・名前・英語名・台数を取得する
+//英語名の行はなくてもよい。メンテナンス中のスポットはnot cyclespotのエラーを返す
+func (p *Parser) ParseSpotText(text string, s *SpotInfo) error {
+	lines := p.Lines(text)
+	if len(lines) < 2 {
+		return fmt.Errorf("[Error]ParseSpotInfoByText unexpected html : %s", text)
+	}
+	if p.maintenanceLine.MatchString(lines[0]) {
+		return fmt.Errorf("[Error]ParseSpotInfoByText not cyclespot : %s", text)
+	}
+	m := p.spotLine.FindStringSubmatch(lines[0])
+	if m == nil {
+		return fmt.Errorf("[Error]ParseSpotInfoByText unexpected code : %s", text)
+	}
+	s.SpotCode = SpotCode{Area: m[1], Spot: m[2]}
+	s.NameJa = strings.TrimSpace(m[3])
+
+	//台数は最後の行
+	c := p.countLine.FindStringSubmatch(lines[len(lines)-1])
+	if c == nil {
+		return fmt.Errorf("[Error]ParseSpotInfoByText count not obtained : %s", text)
+	}
+	count, err := strconv.Atoi(c[1])
+	if err != nil {
+		return fmt.Errorf("[Error]ParseSpotInfoByText count not obtained : %s", text)
+	}
+	s.Count = count
+
+	//英語名（日本語名と同じ場合は英語名がないものとする）
+	s.NameEn = ""
+	if len(lines) >= 3 {
+		if e := p.englishLine.FindStringSubmatch(lines[1]); e != nil {
+			s.NameEn = strings.TrimSpace(e[1])
+		}
+	}
+	if s.NameEn == s.NameJa {
+		s.NameEn = ""
+	}
+	return nil
+}
+
+//SpotEntries スポット一覧の1スポット分の要素
+func (p *Parser) SpotEntries(doc *goquery.Document) *goquery.Selection {
+	return doc.Find(p.SpotEntry)
+}
+
+//IsErrorPage エラーページならメッセージを返す
+func (p *Parser) IsErrorPage(doc *goquery.Document) (string, bool) {
+	if title := doc.Find(p.ErrorTitle).Text(); strings.Contains(title, p.ErrorKeyword) {
+		return strings.TrimSpace(doc.Find(p.ErrorMessage).Text()), true
+	}
+	return "", false
+}
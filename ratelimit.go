@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////
+// レート制限
+//////////////////////////////////////////////////////////////////////////////////////
+
+//TokenBucket トークンバケットによるレート制限（全エリア・全アカウントで共有する）
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+//portalLimiter ポータルへのリクエストのレート制限（起動時に設定から作り直す）
+var portalLimiter = NewTokenBucket(1, 1)
+
+//NewTokenBucket 1秒あたりrate回、最大burst回まで連続で許可するレート制限を作成する
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+//reserve トークンを1つ予約し、使えるようになるまでの待ち時間を返す
+func (b *TokenBucket) reserve() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 || b.rate <= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+//Wait トークンが使えるようになるまで待つ（リプレイモードでは待たない）
+//キャンセルされた場合は予約したトークンを返してエラーを返す
+func (b *TokenBucket) Wait(ctx context.Context) error {
+	if replayDir() != "" {
+		return ctx.Err()
+	}
+	d := b.reserve()
+	if d == 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		b.mu.Lock()
+		b.tokens++
+		b.mu.Unlock()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////
+// ローマ字変換（英語名がないスポットの代わりの名前）
+//////////////////////////////////////////////////////////////////////////////////////
+
+//kanaRomaji カタカナのヘボン式ローマ字（ひらがなはカタカナにしてから引く）
+var kanaRomaji = map[rune]string{
+	'ア': "a", 'イ': "i", 'ウ': "u", 'エ': "e", 'オ': "o",
+	'カ': "ka", 'キ': "ki", 'ク': "ku", 'ケ': "ke", 'コ': "ko",
+	'ガ': "ga", 'ギ': "gi", 'グ': "gu", 'ゲ': "ge", 'ゴ': "go",
+	'サ': "sa", 'シ': "shi", 'ス': "su", 'セ': "se", 'ソ': "so",
+	'ザ': "za", 'ジ': "ji", 'ズ': "zu", 'ゼ': "ze", 'ゾ': "zo",
+	'タ': "ta", 'チ': "chi", 'ツ': "tsu", 'テ': "te", 'ト': "to",
+	'ダ': "da", 'ヂ': "ji", 'ヅ': "zu", 'デ': "de", 'ド': "do",
+	'ナ': "na", 'ニ': "ni", 'ヌ': "nu", 'ネ': "ne", 'ノ': "no",
+	'ハ': "ha", 'ヒ': "hi", 'フ': "fu", 'ヘ': "he", 'ホ': "ho",
+	'バ': "ba", 'ビ': "bi", 'ブ': "bu", 'ベ': "be", 'ボ': "bo",
+	'パ': "pa", 'ピ': "pi", 'プ': "pu", 'ペ': "pe", 'ポ': "po",
+	'マ': "ma", 'ミ': "mi", 'ム': "mu", 'メ': "me", 'モ': "mo",
+	'ヤ': "ya", 'ユ': "yu", 'ヨ': "yo",
+	'ラ': "ra", 'リ': "ri", 'ル': "ru", 'レ': "re", 'ロ': "ro",
+	'ワ': "wa", 'ヰ': "i", 'ヱ': "e", 'ヲ': "o", 'ン': "n", 'ヴ': "vu",
+}
+
+//smallKana 前の文字と組み合わせる小書きの仮名（キャ、ファなど）の母音
+var smallKana = map[rune]string{
+	'ャ': "a", 'ュ': "u", 'ョ': "o",
+	'ァ': "a", 'ィ': "i", 'ゥ': "u", 'ェ': "e", 'ォ': "o", 'ヮ': "a",
+}
+
+//romajiSymbols 記号の置き換え（全角の英数字は半角にする）
+var romajiSymbols = map[rune]string{
+	'・': " ", '　': " ", '（': "(", '）': ")", '－': "-", '‐': "-", '〜': "-", '～': "-", '、': ",", '。': ".",
+}
+
+//Romanize 仮名と全角英数字の名前をローマ字にする（単語の先頭は大文字）
+//漢字の読みは辞書がないと決められないため変換しない。漢字など変換できない文字を1文字でも含む場合はfalseを返す（一部だけローマ字にした名前は返さない）
+func Romanize(text string) (string, bool) {
+	var syllables []string
+	//geminate 促音で子音を重ねる音節（小書きの仮名を組み合わせてから重ねる）
+	geminate := map[int]bool{}
+	sokuon := false
+	for _, r := range text {
+		//ひらがなはカタカナにする
+		if r >= 'ぁ' && r <= 'ゖ' {
+			r += 'ァ' - 'ぁ'
+		}
+		switch {
+		case r == 'ッ':
+			sokuon = true
+			continue
+		case r == 'ー':
+			//長音は表記しない
+			continue
+		case smallKana[r] != "" && len(syllables) > 0 && isKanaSyllable(syllables[len(syllables)-1]):
+			syllables[len(syllables)-1] = combineSmallKana(syllables[len(syllables)-1], r)
+			continue
+		}
+		var s string
+		if romaji, exist := kanaRomaji[r]; exist {
+			s = romaji
+		} else if vowel, exist := smallKana[r]; exist {
+			s = vowel
+		} else if symbol, exist := romajiSymbols[r]; exist {
+			s = symbol
+		} else if r >= '！' && r <= '～' {
+			s = string(r - '！' + '!')
+		} else if r <= unicode.MaxASCII {
+			s = string(r)
+		} else {
+			return "", false
+		}
+		if sokuon && s != "" && !strings.ContainsAny(s[:1], "aiueon ") {
+			geminate[len(syllables)] = true
+		}
+		sokuon = false
+		syllables = append(syllables, s)
+	}
+	//促音は次の子音を重ねる（チはtchにする）
+	for i := range geminate {
+		if strings.HasPrefix(syllables[i], "ch") {
+			syllables[i] = "t" + syllables[i]
+		} else {
+			syllables[i] = syllables[i][:1] + syllables[i]
+		}
+	}
+	words := strings.Fields(strings.Join(syllables, ""))
+	for i, w := range words {
+		words[i] = strings.ToUpper(w[:1]) + w[1:]
+	}
+	return strings.Join(words, " "), true
+}
+
+//isKanaSyllable 仮名から変換した音節か（英数字や記号には小書きの仮名を組み合わせない）
+func isKanaSyllable(s string) bool {
+	for _, romaji := range kanaRomaji {
+		if s == romaji {
+			return true
+		}
+	}
+	return false
+}
+
+//combineSmallKana 音節と小書きの仮名を組み合わせる（キ+ャ=kya, シ+ャ=sha, フ+ァ=fa, ウ+ィ=wi）
+func combineSmallKana(base string, small rune) string {
+	vowel := smallKana[small]
+	stem := base[:len(base)-1]
+	switch small {
+	case 'ャ', 'ュ', 'ョ':
+		if stem == "sh" || stem == "ch" || stem == "j" {
+			return stem + vowel
+		}
+		return stem + "y" + vowel
+	}
+	if stem == "" {
+		stem = "w"
+	}
+	return stem + vowel
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ant0ine/go-json-rest/rest"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////
+// 定期実行スケジューラ
+//////////////////////////////////////////////////////////////////////////////////////
+
+//MissedThreshold 予定時刻からこれ以上遅れて起きた場合は実行漏れとみなす
+const MissedThreshold = time.Minute
+
+//ScheduleDef スケジュール定義（設定ファイルのschedulesまたは環境変数SCHEDULESにJSON配列で指定する）
+type ScheduleDef struct {
+	Name string `json:"name"`
+	Cron string `json:"cron"`
+	//Kind 処理の種類（counts:台数, master:マスタ, recover:リカバリ）
+	Kind string `json:"kind"`
+	//ProfileName 使用するプロファイル（省略時はdefault）。id, passwordなどを直接指定した項目はそちらを優先する
+	ProfileName string `json:"profile"`
+	Profile
+	//Jitter 実行時刻をずらす最大秒数
+	Jitter int `json:"jitter"`
+	//Missed 実行漏れ時の動作（skip:次回まで待つ, run:すぐに1回だけ実行する）
+	Missed string `json:"missed"`
+	//Max リカバリで一回に処理するファイル数
+	Max      int  `json:"max"`
+	Disabled bool `json:"disabled"`
+}
+
+//Schedule 登録済みスケジュール
+type Schedule struct {
+	ScheduleDef
+	cron      *CronSchedule
+	mu        sync.Mutex
+	enabled   bool
+	running   bool
+	next      time.Time
+	lastRun   time.Time
+	lastError string
+	skipped   int
+}
+
+//ScheduleStatus スケジュールの状態（/schedulesで返す）
+type ScheduleStatus struct {
+	Name      string `json:"name"`
+	Cron      string `json:"cron"`
+	Kind      string `json:"kind"`
+	Enabled   bool   `json:"enabled"`
+	Running   bool   `json:"running"`
+	Next      string `json:"next"`
+	LastRun   string `json:"lastRun"`
+	LastError string `json:"lastError"`
+	Skipped   int    `json:"skipped"`
+}
+
+//Scheduler スケジューラ
+type Scheduler struct {
+	mu        sync.Mutex
+	schedules []*Schedule
+}
+
+//scheduler スケジューラ
+var scheduler = &Scheduler{}
+
+//Add スケジュールを登録する
+func (sc *Scheduler) Add(def ScheduleDef) error {
+	if def.Name == "" {
+		return fmt.Errorf("schedule name is required")
+	}
+	switch def.Kind {
+	case "counts", "master", "recover":
+	default:
+		return fmt.Errorf("unknown schedule kind : %s", def.Kind)
+	}
+	cron, err := ParseCron(def.Cron)
+	if err != nil {
+		return err
+	}
+	if def.Kind != "recover" {
+		prof, err := config.Profile(def.ProfileName)
+		if err != nil && def.ProfileName != "" {
+			return err
+		}
+		if _, err := def.Profile.Merge(prof).RunParam(def.Kind); err != nil {
+			return fmt.Errorf("schedule %s : %v", def.Name, err)
+		}
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.find(def.Name) != nil {
+		return fmt.Errorf("duplicate schedule name : %s", def.Name)
+	}
+	sc.schedules = append(sc.schedules, &Schedule{ScheduleDef: def, cron: cron, enabled: !def.Disabled})
+	return nil
+}
+
+//LoadSchedules 設定のスケジュールを登録する
+func (sc *Scheduler) LoadSchedules(defs []ScheduleDef) error {
+	for _, def := range defs {
+		if err := sc.Add(def); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//find 名前でスケジュールを探す（ロックは呼び出し元で取る）
+func (sc *Scheduler) find(name string) *Schedule {
+	for _, s := range sc.schedules {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+//Get 名前でスケジュールを返す
+func (sc *Scheduler) Get(name string) *Schedule {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.find(name)
+}
+
+//Start 全スケジュールの実行を開始する
+func (sc *Scheduler) Start() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for _, s := range sc.schedules {
+		logger.Info("schedule start", "schedule", s.Name, "cron", s.Cron, "kind", s.Kind)
+		go s.loop()
+	}
+}
+
+//Stop 全スケジュールを無効にする（終了時に新しい実行を始めないため）
+func (sc *Scheduler) Stop() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for _, s := range sc.schedules {
+		s.SetEnabled(false)
+	}
+}
+
+//Status 全スケジュールの状態を返す
+func (sc *Scheduler) Status() []ScheduleStatus {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	result := []ScheduleStatus{}
+	for _, s := range sc.schedules {
+		result = append(result, s.Status())
+	}
+	return result
+}
+
+//loop 次回時刻まで待って実行することを繰り返す
+func (s *Schedule) loop() {
+	next := s.cron.Next(time.Now())
+	for !next.IsZero() {
+		s.mu.Lock()
+		s.next = next
+		s.mu.Unlock()
+		//負荷分散のため実行時刻をずらす
+		var jitter time.Duration
+		if s.Jitter > 0 {
+			jitter = time.Duration(rand.Int63n(int64(s.Jitter) * int64(time.Second)))
+		}
+		time.Sleep(time.Until(next) + jitter)
+		now := time.Now()
+		//dynoのスリープなどで予定時刻を大きく過ぎていた場合
+		if now.Sub(next) > jitter+MissedThreshold && s.Missed != "run" {
+			logger.Warn("schedule missed", "schedule", s.Name, "planned", next.Format(TimeLayout))
+			s.mu.Lock()
+			s.skipped++
+			s.mu.Unlock()
+		} else {
+			s.trigger()
+		}
+		next = s.cron.Next(now)
+	}
+	logger.Error("schedule has no next time", "schedule", s.Name, "cron", s.Cron)
+}
+
+//trigger 非同期で実行する（無効時と前回実行中はスキップ）
+func (s *Schedule) trigger() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.enabled {
+		return
+	}
+	if s.running {
+		logger.Warn("schedule skipped (previous run is still running)", "schedule", s.Name)
+		s.skipped++
+		return
+	}
+	s.running = true
+	s.lastRun = time.Now()
+	go func() {
+		err := s.run("schedule:" + s.Name)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.running = false
+		s.lastError = ""
+		if err != nil {
+			logger.Error("schedule run failed", "schedule", s.Name, "error", err)
+			s.lastError = err.Error()
+		}
+	}()
+}
+
+//run スケジュールの処理をジョブとして実行する
+func (s *Schedule) run(trigger string) error {
+	if s.Kind == "recover" {
+		max := s.Max
+		if max <= 0 {
+			max = 5
+		}
+		spool.Drain(jobs.New(s.Kind, trigger, ""), max, false)
+		return nil
+	}
+	//実行時にプロファイルを補う（認証情報の更新を反映するため）
+	prof := s.Profile
+	if base, err := config.Profile(s.ProfileName); err == nil {
+		prof = prof.Merge(base)
+	}
+	job := jobs.New(s.Kind, trigger, prof.ID)
+	p, err := prof.RunParam(s.Kind)
+	if err != nil {
+		job.Finish(err)
+		return err
+	}
+	p.Job = job
+	if p.Session, err = sessions.Get(job.Context(), job.Logger(), p.City, prof.ID, prof.Password); err != nil {
+		job.Finish(err)
+		return err
+	}
+	if s.Kind == "master" {
+		return RegAllSpotMaster(job.Context(), p)
+	}
+	return RegAllSpotInfo(job.Context(), p)
+}
+
+//SetEnabled 有効・無効を切り替える
+func (s *Schedule) SetEnabled(enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.enabled = enabled
+}
+
+//Status スケジュールの状態を返す
+func (s *Schedule) Status() ScheduleStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := ScheduleStatus{
+		Name:      s.Name,
+		Cron:      s.Cron,
+		Kind:      s.Kind,
+		Enabled:   s.enabled,
+		Running:   s.running,
+		LastError: s.lastError,
+		Skipped:   s.skipped,
+	}
+	if !s.next.IsZero() {
+		status.Next = s.next.Format(TimeLayout)
+	}
+	if !s.lastRun.IsZero() {
+		status.LastRun = s.lastRun.Format(TimeLayout)
+	}
+	return status
+}
+
+//GetSchedules スケジュール一覧を返す
+func GetSchedules(w rest.ResponseWriter, r *rest.Request) {
+	w.WriteJson(scheduler.Status())
+}
+
+//EnableSchedule スケジュールを有効にする
+func EnableSchedule(w rest.ResponseWriter, r *rest.Request) {
+	setScheduleEnabled(w, r, true)
+}
+
+//DisableSchedule スケジュールを無効にする
+func DisableSchedule(w rest.ResponseWriter, r *rest.Request) {
+	setScheduleEnabled(w, r, false)
+}
+
+//setScheduleEnabled スケジュールの有効・無効を切り替えて状態を返す
+func setScheduleEnabled(w rest.ResponseWriter, r *rest.Request, enabled bool) {
+	s := scheduler.Get(r.PathParam("name"))
+	if s == nil {
+		rest.NotFound(w, r)
+		return
+	}
+	s.SetEnabled(enabled)
+	w.WriteHeader(http.StatusOK)
+	w.WriteJson(s.Status())
+}
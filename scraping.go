@@ -1,771 +1,988 @@
-package main
-
-import (
-	"bytes"
-	"crypto/tls"
-	"encoding/json"
-	"fmt"
-	"io"
-	"log"
-	"net/http"
-	"net/url"
-	"os"
-	"path/filepath"
-	"runtime"
-	"strconv"
-	"strings"
-	"sync"
-	"time"
-
-	"github.com/PuerkitoBio/goquery"
-	"github.com/ant0ine/go-json-rest/rest"
-)
-
-//////////////////////////////////////////////////////////////////////////////////////
-// 定数
-//////////////////////////////////////////////////////////////////////////////////////
-
-//TimeLayout 時刻フォーマット
-const TimeLayout = "2006/01/02 15:04:05"
-
-//AllSpot 全スポット
-const AllSpot = "1,2,3,5,6,4,10,12,7,8"
-
-//////////////////////////////////////////////////////////////////////////////////////
-// 変数
-//////////////////////////////////////////////////////////////////////////////////////
-
-//lock 排他制御
-var lock = sync.RWMutex{}
-
-//lastExcuted 最終実行時刻
-var lastExcuted int64
-
-//lastRecovered 最終リカバリ時刻
-var lastRecovered int64
-
-//Httpでもらう設定値
-var UserID string
-var Password string
-var SendAddress string
-var AreaIdString string
-var ApiCert string
-
-//SessionID セッション
-var SessionID string
-
-//client HTTPリクエストクライアント（使いまわした方がいいらしいのでグローバル化）
-var client *http.Client
-
-//////////////////////////////////////////////////////////////////////////////////////
-// 構造体
-//////////////////////////////////////////////////////////////////////////////////////
-
-//SpotInfo スクレイピング結果を格納する構造体
-type SpotInfo struct {
-	Time                              time.Time
-	Area, Spot, Count, Name, Lat, Lon string
-}
-
-//JSpotinfo JSONマーシャリング構造体
-type JSpotinfo struct {
-	Spotinfo []InnerSpotinfo `json:"spotinfo"`
-}
-
-//InnerSpotinfo 台数情報
-type InnerSpotinfo struct {
-	Time  string `json:"time"`
-	Area  string `json:"area"`
-	Spot  string `json:"spot"`
-	Count string `json:"count"`
-}
-
-//JSpotmaster JSONマーシャリング構造体
-type JSpotmaster struct {
-	Spotmaster []InnerSpotmaster `json:"spotmaster"`
-}
-
-//InnerSpotmaster スポット情報
-type InnerSpotmaster struct {
-	Area string `json:"area"`
-	Spot string `json:"spot"`
-	Name string `json:"name"`
-	Lat  string `json:"lat"`
-	Lon  string `json:"lon"`
-}
-
-//////////////////////////////////////////////////////////////////////////////////////
-// レシーバ
-//////////////////////////////////////////////////////////////////////////////////////
-
-//Add SpotInfo構造体をJSON用にパースして加える
-func (s *JSpotinfo) Add(time time.Time, area string, spot string, count string) {
-	s.Spotinfo = append(s.Spotinfo, InnerSpotinfo{Time: time.Format(TimeLayout), Area: area, Spot: spot, Count: count})
-}
-
-//Size SpotInfo構造体のサイズを返す
-func (s *JSpotinfo) Size() int {
-	return len(s.Spotinfo)
-}
-
-//Add SpotInfo構造体をJSON用にパースして加える
-func (s *JSpotmaster) Add(area string, spot string, name string, lat string, lon string) {
-	s.Spotmaster = append(s.Spotmaster, InnerSpotmaster{Area: area, Spot: spot, Name: name, Lat: lat, Lon: lon})
-}
-
-//Size SpotInfo構造体のサイズを返す
-func (s *JSpotmaster) Size() int {
-	return len(s.Spotmaster)
-}
-
-//////////////////////////////////////////////////////////////////////////////////////
-// 関数
-//////////////////////////////////////////////////////////////////////////////////////
-
-//GetSessionID ログインしてセッションIDを取得する
-func GetSessionID() (string, error) {
-	//リクエストBody作成
-	values := url.Values{}
-	values.Set("EventNo", "21401")
-	values.Add("GarblePrevention", "ＰＯＳＴデータ")
-	values.Add("MemberID", UserID)
-	values.Add("Password", Password)
-	values.Add("MemAreaID", "1")
-
-	req, err := http.NewRequest(
-		"POST",
-		"https://tcc.docomo-cycle.jp/cycle/TYO/cs_web_main.php",
-		strings.NewReader(values.Encode()),
-	)
-	if err != nil {
-		fmt.Println("[Error]GetSessionID create NewRequest failed", err)
-		return "", err
-	}
-
-	// リクエストHead作成
-	ContentLength := strconv.FormatInt(req.ContentLength, 10)
-	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.9")
-	req.Header.Set("Accept-Encoding", "gzip, deflate, br")
-	req.Header.Set("Accept-Language", "ja,en-US;q=0.9,en;q=0.8,pt;q=0.7")
-	req.Header.Set("Cache-Control", "max-age=0")
-	req.Header.Set("Connection", "keep-alive")
-	req.Header.Set("Content-Length", ContentLength)
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Set("Host", "tcc.docomo-cycle.jp")
-	req.Header.Set("Origin", "https://tcc.docomo-cycle.jp")
-	req.Header.Set("Referer", "https://tcc.docomo-cycle.jp/cycle/TYO/cs_web_main.php")
-	req.Header.Set("Sec-Fetch-Dest", "document")
-	req.Header.Set("Sec-Fetch-Mode", "navigate")
-	req.Header.Set("Sec-Fetch-Site", "same-origin")
-	req.Header.Set("Sec-Fetch-User", "?1")
-	req.Header.Set("Upgrade-Insecure-Requests", "1")
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/80.0.3987.106 Safari/537.36")
-
-	resp, err := client.Do(req)
-	if err != nil {
-		fmt.Println("[Error]GetSessionID client.Do failed", err)
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	doc, e := goquery.NewDocumentFromResponse(resp)
-	if e != nil {
-		fmt.Println("[Error]GetSessionID NewDocumentFromResponse failed", e)
-		return "", e
-	}
-
-	SessionID, success := doc.Find("input[name='SessionID']").Attr("value")
-	if !success {
-		fmt.Println("[Error]GetSessionID Find SessionID failed")
-		return "", fmt.Errorf("error")
-	} else {
-		fmt.Println("GetSessionID success ", SessionID)
-		//成功したら待ち時間（1回目の検索に失敗するため）
-		time.Sleep(3 * time.Second)
-		return SessionID, nil
-	}
-}
-
-//GetSpotInfoMain スクレイピングメイン関数
-func GetSpotInfoMain(AreaID string, retry bool) ([]SpotInfo, error) {
-	fmt.Printf("GetSpotInfoMain_start AreaID = %s \n", AreaID)
-	var list []SpotInfo
-	//リクエストBody作成
-	values := url.Values{}
-	values.Set("EventNo", "25706")
-	values.Add("SessionID", SessionID)
-	values.Add("UserID", "TYO")
-	values.Add("MemberID", UserID)
-	values.Add("GetInfoNum", "200")
-	values.Add("GetInfoTopNum", "1")
-	values.Add("MapType", "1")
-	values.Add("MapCenterLat", "")
-	values.Add("MapCenterLon", "")
-	values.Add("MapZoom", "13")
-	values.Add("EntServiceID", "TYO0001")
-	values.Add("Location", "")
-	values.Add("AreaID", AreaID)
-
-	req, err := http.NewRequest(
-		"POST",
-		"https://tcc.docomo-cycle.jp/cycle/TYO/cs_web_main.php",
-		strings.NewReader(values.Encode()),
-	)
-	if err != nil {
-		fmt.Println("[Error]GetSpotInfoMain create NewRequest failed", err)
-		return nil, err
-	}
-
-	// リクエストHead作成
-	ContentLength := strconv.FormatInt(req.ContentLength, 10)
-	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.9")
-	req.Header.Set("Accept-Encoding", "gzip, deflate, br")
-	req.Header.Set("Accept-Language", "ja,en-US;q=0.9,en;q=0.8,pt;q=0.7")
-	req.Header.Set("Cache-Control", "max-age=0")
-	req.Header.Set("Connection", "keep-alive")
-	req.Header.Set("Content-Length", ContentLength)
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Set("Host", "tcc.docomo-cycle.jp")
-	req.Header.Set("Origin", "https://tcc.docomo-cycle.jp")
-	req.Header.Set("Referer", "https://tcc.docomo-cycle.jp/cycle/TYO/cs_web_main.php")
-	req.Header.Set("Sec-Fetch-Dest", "document")
-	req.Header.Set("Sec-Fetch-Mode", "navigate")
-	req.Header.Set("Sec-Fetch-Site", "same-origin")
-	req.Header.Set("Sec-Fetch-User", "?1")
-	req.Header.Set("Upgrade-Insecure-Requests", "1")
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/80.0.3987.106 Safari/537.36")
-
-	resp, err := client.Do(req)
-	if err != nil {
-		fmt.Println("[Error]GetSpotInfoMain client.Do failed", err.Error())
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	doc, e := goquery.NewDocumentFromResponse(resp)
-	if e != nil {
-		fmt.Println("[Error]GetSpotInfoMain NewDocumentFromResponse failed", e)
-		return nil, e
-	}
-
-	//エラーならログインし直して再チャレンジ
-	if err := CheckErrorPage(doc); err != nil {
-		if retry {
-			SessionID, err = GetSessionID()
-			if err != nil {
-				return nil, err
-			}
-			//再帰呼び出し（次はリトライしない）
-			return GetSpotInfoMain(AreaID, false)
-		} else {
-			//２回目は諦める
-			return nil, err
-		}
-	}
-
-	//スポットリスト解析
-	doc.Find("form[name^=tab_]").Each(func(i int, s *goquery.Selection) {
-		spotinfo := SpotInfo{Time: time.Now()}
-		html, _ := s.Find("a").Html()
-		err := ParseSpotInfoByText(html, &spotinfo)
-		if err != nil {
-			//メンテナンス中のスポットのエラーログは出力しない
-			if strings.Index(err.Error(), "not cyclespot") < 0 {
-				fmt.Println("[Error]GetSpotInfoMain ParseSpotInfoByText failed", err)
-			}
-			return
-		}
-		if val, exist := s.Find("input[name=ParkingLat]").Attr("value"); exist {
-			spotinfo.Lat = val
-		}
-		if val, exist := s.Find("input[name=ParkingLon]").Attr("value"); exist {
-			spotinfo.Lon = val
-		}
-		list = append(list, spotinfo)
-	})
-
-	fmt.Printf("GetSpotInfoMain_end AreaID = %s (%d件)\n", AreaID, len(list))
-	return list, nil
-}
-
-//ParseSpotInfoByText テキスト解析
-// "H1-43.東京イースト21<br/>H1-43.Tokyo East 21<br/>13台"の形式のテキストからarea,spot,name,countを取得する
-func ParseSpotInfoByText(text string, s *SpotInfo) error {
-	var codeAndName, cycleCount string
-	if arr := strings.Split(text, "<br/>"); len(arr) == 3 {
-		codeAndName = arr[0]
-		cycleCount = arr[2]
-	} else {
-		return fmt.Errorf("[Error]ParseSpotInfoByText unexpected html : " + text)
-	}
-
-	// "H1-43"の部分
-	indexDot := strings.Index(codeAndName, ".")
-	if indexDot < 0 {
-		return fmt.Errorf("[Error]ParseSpotInfoByText not cyclespot : " + text)
-	}
-	code := codeAndName[:indexDot]
-	if arr := strings.Split(code, "-"); len(arr) == 2 {
-		s.Area = arr[0]
-		s.Spot = arr[1]
-	} else {
-		return fmt.Errorf("[Error]ParseSpotInfoByText unexpected code : " + text)
-	}
-
-	//名前
-	s.Name = codeAndName[indexDot+1:]
-	//台数
-	if _, err := strconv.Atoi(cycleCount[:len(cycleCount)-3]); err == nil {
-		s.Count = cycleCount[:len(cycleCount)-3]
-	} else {
-		return fmt.Errorf("[Error]ParseSpotInfoByText count not obtained : " + text)
-	}
-
-	//データサイズチェック
-	if len(s.Area) > 3 || len(s.Spot) > 3 || len(s.Count) > 3 {
-		fmt.Println("[Error]ParseSpotInfoByText data size obver : " + text)
-	}
-
-	return nil
-}
-
-//RegAllSpotInfo 全スポット登録関数
-func RegAllSpotInfo() (err error) {
-	//ロックする
-	lock.Lock()
-	defer lock.Unlock()
-	//特に指定してない場合は全スポット
-	if AreaIdString == "" {
-		AreaIdString = AllSpot
-	}
-	fmt.Println("RegAllSpotInfo_Start AreaIdString =", AreaIdString)
-	AreaIDs := strings.Split(AreaIdString, ",")
-	for _, AreaID := range AreaIDs {
-		if AreaID == "" {
-			continue
-		}
-		//待ち時間いれる
-		time.Sleep(5 * time.Second)
-		//台数取得
-		var list []SpotInfo
-		list, err = GetSpotInfoMain(AreaID, true)
-		if err != nil {
-			fmt.Println("[Error]RegAllSpotInfo GetSpotInfoMain failed AreaID =", AreaID, err)
-			continue
-		}
-		//負荷緩和のため100件ずつ送信
-		max := 100
-		jsondata := JSpotinfo{}
-		for _, s := range list {
-			jsondata.Add(s.Time, s.Area, s.Spot, s.Count)
-			if jsondata.Size() >= max {
-				SendSpotInfo(jsondata, false)
-				jsondata = JSpotinfo{}
-				time.Sleep(1 * time.Second)
-			}
-		}
-		if jsondata.Size() >= 1 {
-			SendSpotInfo(jsondata, false)
-		}
-	}
-	fmt.Println("RegAllSpotInfo_End")
-	return nil
-}
-
-//RegAllSpotMaster 全スポット登録関数（マスタメンテナンス）
-func RegAllSpotMaster() (err error) {
-	fmt.Println("RegAllSpotMaster_Start")
-	//マスタメンテでは全スポットを対象とする
-	AreaIDs := strings.Split(AllSpot, ",")
-	for _, AreaID := range AreaIDs {
-		//待ち時間いれる
-		time.Sleep(5 * time.Second)
-		//台数取得
-		var list []SpotInfo
-		list, err = GetSpotInfoMain(AreaID, true)
-		if err != nil {
-			fmt.Println("[Error]RegAllSpotMaster GetSpotInfoMain failed AreaID =", AreaID, err)
-			continue
-		}
-		//負荷緩和のため100件ずつ送信
-		max := 100
-		jsondata := JSpotmaster{}
-		for _, s := range list {
-			jsondata.Add(s.Area, s.Spot, s.Name, s.Lat, s.Lon)
-			if jsondata.Size() >= max {
-				SendSpotMaster(jsondata)
-				jsondata = JSpotmaster{}
-				time.Sleep(1 * time.Second)
-			}
-		}
-		if jsondata.Size() >= 1 {
-			SendSpotMaster(jsondata)
-		}
-	}
-	fmt.Println("RegAllSpotMaster_End")
-	return nil
-}
-
-//CheckErrorPage エラーページかをチェックする
-func CheckErrorPage(doc *goquery.Document) error {
-	if title := doc.Find(".tittle_h1").Text(); strings.Index(title, "エラー") > -1 {
-		fmt.Println(title)
-		return fmt.Errorf(strings.TrimSpace(doc.Find(".main_inner_message").Text()))
-	}
-	return nil
-}
-
-//SendSpotInfo DBに送信する。JSONファイルからのリカバリの場合は失敗したらJSONを保存しないフラグ（第２引数）
-func SendSpotInfo(jsonStruct JSpotinfo, fromRecovery bool) error {
-	marshalized, _ := json.Marshal(jsonStruct)
-	req, err := http.NewRequest(
-		"POST",
-		SendAddress,
-		bytes.NewBuffer(marshalized),
-	)
-	if err != nil {
-		fmt.Println("[Error]SendSpotInfo create NewRequest failed", err.Error())
-		return err
-	}
-
-	// リクエストHead作成
-	ContentLength := strconv.FormatInt(req.ContentLength, 10)
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Content-Length", ContentLength)
-	req.Header.Set("cert", ApiCert)
-
-	//送信
-	resp, err := client.Do(req)
-	if err != nil {
-		fmt.Println("[Error]SendSpotInfo client.Do failed", err.Error())
-		if !fromRecovery {
-			SaveJSON(jsonStruct)
-		}
-		return err
-	}
-	if resp.StatusCode != http.StatusOK {
-		fmt.Println("[Error]SendSpotInfo StatusCode is not OK", resp.StatusCode, resp.Body)
-		if !fromRecovery {
-			SaveJSON(jsonStruct)
-		}
-		return fmt.Errorf("StatusCode is not OK : %d", resp.StatusCode)
-	}
-	defer resp.Body.Close()
-	return nil
-}
-
-//SendSpotMaster マスタ情報をDBに送信する。
-func SendSpotMaster(jsonStruct JSpotmaster) error {
-	marshalized, _ := json.Marshal(jsonStruct)
-	req, err := http.NewRequest(
-		"POST",
-		SendAddress,
-		bytes.NewBuffer(marshalized),
-	)
-	if err != nil {
-		fmt.Println("[Error]SendSpotMaster create NewRequest failed", err.Error())
-		return err
-	}
-
-	// リクエストHead作成
-	ContentLength := strconv.FormatInt(req.ContentLength, 10)
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Content-Length", ContentLength)
-	req.Header.Set("cert", ApiCert)
-
-	//送信
-	resp, err := client.Do(req)
-	if err != nil {
-		fmt.Println("[Error]SendSpotMaster client.Do failed", err.Error())
-		return err
-	}
-	if resp.StatusCode != http.StatusOK {
-		fmt.Println("[Error]SendSpotMaster StatusCode is not OK", resp.StatusCode, resp.Body)
-		return fmt.Errorf("StatusCode is not OK : %d", resp.StatusCode)
-	}
-	defer resp.Body.Close()
-	return nil
-}
-
-//TestGetSpotInfoMain 単体テスト
-func TestGetSpotInfoMain(html string) ([]SpotInfo, error) {
-	var list []SpotInfo
-	// ファイルからドキュメントを作成（テスト用）
-	f, e := os.Open(html)
-	if e != nil {
-		log.Fatal(e)
-	}
-	defer f.Close()
-
-	doc, e := goquery.NewDocumentFromReader(f)
-	if e != nil {
-		log.Fatal(e)
-	}
-
-	//スポットリスト解析
-	doc.Find("form[name^=tab_]").Each(func(i int, s *goquery.Selection) {
-		spotinfo := SpotInfo{Time: time.Now()}
-		html, _ := s.Find("a").Html()
-		err := ParseSpotInfoByText(html, &spotinfo)
-		if err != nil {
-			return
-		}
-		if val, exist := s.Find("input[name=ParkingLat]").Attr("value"); exist {
-			spotinfo.Lat = val
-		}
-		if val, exist := s.Find("input[name=ParkingLon]").Attr("value"); exist {
-			spotinfo.Lon = val
-		}
-		list = append(list, spotinfo)
-	})
-
-	return list, nil
-
-}
-
-//PrepareScrayping スクレイピング準備（返り値がtrueの場合は実行しない）
-func PrepareScrayping(w rest.ResponseWriter, r *rest.Request) (cancel bool) {
-	//2分以内の連続実行を禁止する
-	if now := time.Now().Unix(); now-lastExcuted < 120 {
-		fmt.Println("2分以内に連続でリクエストされたためキャンセルしました。")
-		w.WriteHeader(http.StatusOK)
-		w.WriteJson("scraping canceled")
-		return true
-	}
-	lastExcuted = time.Now().Unix()
-	//パラメータ解析
-	r.ParseForm()
-	params := r.Form
-	SendAddress = params.Get("address")
-	if params.Get("id") == "" || params.Get("password") == "" || SendAddress == "" {
-		w.WriteHeader(http.StatusForbidden)
-		w.WriteJson("[ERROR] lack of parameter")
-		return true
-	}
-	AreaIdString = params.Get("areaID")
-	if env := params.Get("env"); env != "" {
-		os.Setenv("API_CERT", env)
-	}
-	//引数で渡さなくても環境変数にある場合がある
-	if val := os.Getenv("API_CERT"); val != "" {
-		ApiCert = val
-	}
-	//セッションIDを使いまわす
-	var err error
-	if SessionID == "" {
-		//空なら取得
-		UserID = params.Get("id")
-		Password = params.Get("password")
-		SessionID, err = GetSessionID()
-		if err != nil {
-			fmt.Println("[Error]Start GetSessionID failed", err)
-			w.WriteHeader(http.StatusBadRequest)
-			w.WriteJson("login failed")
-			return true
-		}
-	} else {
-		if UserID != params.Get("id") || Password != params.Get("password") {
-			//前回ログイン情報と異なる場合はログインし直し
-			UserID = params.Get("id")
-			Password = params.Get("password")
-			SessionID, err = GetSessionID()
-			if err != nil {
-				fmt.Println("[Error]Start GetSessionID failed", err)
-				w.WriteHeader(http.StatusBadRequest)
-				w.WriteJson("login failed")
-				return true
-			}
-		}
-	}
-	return false
-}
-
-//Start スクレイピング開始
-func Start(w rest.ResponseWriter, r *rest.Request) {
-	//チェック＆初期化
-	if cancel := PrepareScrayping(w, r); cancel {
-		return
-	}
-	//スクレイピング実行（非同期）
-	go RegAllSpotInfo()
-	//先にOKを返しておく
-	w.WriteHeader(http.StatusOK)
-	w.WriteJson("OK")
-}
-
-//StartMaster スクレイピング開始
-func StartMaster(w rest.ResponseWriter, r *rest.Request) {
-	//チェック＆初期化
-	if cancel := PrepareScrayping(w, r); cancel {
-		return
-	}
-	//スクレイピング実行（非同期）
-	go RegAllSpotMaster()
-	//先にOKを返しておく
-	w.WriteHeader(http.StatusOK)
-	w.WriteJson("OK")
-}
-
-//InitClient クライアント初期化
-func InitClient() {
-	//SSL証明書を無視したクライアント作成
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-	client = &http.Client{
-		Transport: tr,
-	}
-}
-
-//SaveJSON JSONファイルに保存する
-func SaveJSON(jsonStruct JSpotinfo) error {
-	filePath := strconv.FormatInt(time.Now().Unix(), 10) + "_save.json"
-	if runtime.GOOS != "windows" {
-		filePath = "/tmp/" + filePath
-	}
-	fp, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY, 0664)
-	if err != nil {
-		fmt.Println(err.Error())
-		return err
-	}
-	defer fp.Close()
-
-	e := json.NewEncoder(fp)
-	if err := e.Encode(jsonStruct); err != nil {
-		fmt.Println(err.Error())
-		return err
-	}
-	return nil
-}
-
-//EnumTempFiles 一時ファイルを列挙する
-func EnumTempFiles() (result []string) {
-	pattern := "*_save.json"
-	if runtime.GOOS != "windows" {
-		pattern = "/tmp/" + pattern
-	}
-	if files, err := filepath.Glob(pattern); err != nil {
-		fmt.Println("EnumTempFiles_Error :", err.Error())
-	} else {
-		result = files
-	}
-	return
-}
-
-//Recover JSONからリカバリー
-func Recover(w rest.ResponseWriter, r *rest.Request) {
-	//パラメータ解析
-	r.ParseForm()
-	params := r.Form
-	//最大件数
-	max := 5
-	if param := params.Get("max"); param != "" {
-		if val, err := strconv.Atoi(param); err == nil {
-			max = val
-		}
-	}
-	//max=0のときは件数確認のみのためチェックしない
-	if max > 0 {
-		if lastExcuted <= 0 {
-			fmt.Println("未初期化のためキャンセルしました。")
-			w.WriteHeader(http.StatusOK)
-			w.WriteJson("recovery canceled")
-			return
-		}
-		//2分以内の連続実行を禁止する
-		if now := time.Now().Unix(); now-lastRecovered < 120 {
-			fmt.Println("2分以内に連続でリクエストされたためキャンセルしました。")
-			w.WriteHeader(http.StatusOK)
-			w.WriteJson("recovery canceled")
-			return
-		}
-		lastRecovered = time.Now().Unix()
-	}
-
-	//tmpファイルを列挙
-	files := EnumTempFiles()
-	if len(files) < 1 {
-		fmt.Println("tmpにファイルがありません")
-		w.WriteHeader(http.StatusOK)
-		w.WriteJson("no recovery cache found")
-		return
-	} else if max == 0 {
-		msg := fmt.Sprintf("%d files found : %v \n", len(files), files)
-		fmt.Printf(msg)
-		w.WriteHeader(http.StatusOK)
-		w.WriteJson(msg)
-		return
-	}
-	for i, filename := range files {
-		if i >= max {
-			break
-		}
-		path := filename
-		// if runtime.GOOS != "windows" {
-		// 	path = "/tmp/" + path
-		// }
-		file, err := os.Open(path)
-		if err != nil {
-			msg := fmt.Sprintf("%s Open error : %v", path, err)
-			fmt.Println(msg)
-			w.WriteHeader(http.StatusOK)
-			w.WriteJson(msg)
-			return
-		}
-		defer file.Close()
-		d := json.NewDecoder(file)
-		d.DisallowUnknownFields() // エラーの場合 json: unknown field "JSONのフィールド名"
-		var jsonstruct JSpotinfo
-		if err := d.Decode(&jsonstruct); err != nil && err != io.EOF {
-			msg := fmt.Sprintf("%s Decode error : %v", path, err)
-			fmt.Println(msg)
-			w.WriteHeader(http.StatusOK)
-			w.WriteJson(msg)
-			return
-		}
-		//DB登録処理
-		if err := SendSpotInfo(jsonstruct, true); err != nil {
-			//同じファイルで失敗し続けないようにしたいが何回かリトライのチャンスを与えたいのでMAX回数を引き上げる
-			max++
-			fmt.Printf("%s SendSpotInfo error : %v \n", path, err)
-		} else {
-			//成功したらファイル削除
-			if err := os.Remove(path); err != nil {
-				fmt.Printf("%s Remove error : %v \n", path, err)
-				continue
-			}
-			fmt.Printf("%s Recover success \n", path)
-		}
-	}
-}
-
-// func main() {
-// 	// list, _ := TestGetSpotInfoMain("./港.html")
-// 	// SaveJSON(ConvertSpotinfoStruct(list))
-// 	SendAddress = "http://localhost:5001/private/counts"
-
-// }
-
-func main() {
-	api := rest.NewApi()
-	api.Use(rest.DefaultDevStack...)
-	router, err := rest.MakeRouter(
-		rest.Get("/start", Start),
-		rest.Get("/master", StartMaster),
-		rest.Get("/recover", Recover),
-	)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	if err != nil {
-		log.Fatal(err)
-	}
-	api.SetApp(router)
-	port := "5005"
-	if val := os.Getenv("PORT"); val != "" {
-		port = val
-	}
-	InitClient()
-	log.Fatal(http.ListenAndServe(":"+port, api.MakeHandler()))
-}
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/ant0ine/go-json-rest/rest"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////
+// 定数
+//////////////////////////////////////////////////////////////////////////////////////
+
+//TimeLayout 時刻フォーマット
+const TimeLayout = "2006/01/02 15:04:05"
+
+//AllSpot 全スポット（東京の全エリア）
+const AllSpot = "1,2,3,5,6,4,10,12,7,8"
+
+//SpotPageSize 1ページで取得するスポット数（GetInfoNum）
+const SpotPageSize = 200
+
+//MaxSpotPages 1エリアで取得する最大ページ数（ポータルがGetInfoTopNumを無視した場合の無限ループ防止）
+const MaxSpotPages = 20
+
+//HTTPTimeout 1回のHTTPリクエストの制限時間（送信先やポータルが応答しない場合に止まったままにしない）
+const HTTPTimeout = 60 * time.Second
+
+//////////////////////////////////////////////////////////////////////////////////////
+// 変数
+//////////////////////////////////////////////////////////////////////////////////////
+
+//lastExcuted 最終実行時刻（いずれかのアカウントで実行された時刻）
+var lastExcuted int64
+
+//lastRecovered 最終リカバリ時刻
+var lastRecovered int64
+
+//Httpでもらう設定値
+var SendAddress string
+
+//client HTTPリクエストクライアント（使いまわした方がいいらしいのでグローバル化）
+var client *http.Client
+
+//loginWait ログイン成功後の待ち時間（すぐに検索すると失敗するため）
+var loginWait = 3 * time.Second
+
+//////////////////////////////////////////////////////////////////////////////////////
+// 構造体
+//////////////////////////////////////////////////////////////////////////////////////
+
+//JSpotinfo JSONマーシャリング構造体
+type JSpotinfo struct {
+	Spotinfo []InnerSpotinfo `json:"spotinfo"`
+}
+
+//InnerSpotinfo 台数情報
+type InnerSpotinfo struct {
+	Time  string `json:"time"`
+	City  string `json:"city"`
+	Area  string `json:"area"`
+	Spot  string `json:"spot"`
+	Count string `json:"count"`
+}
+
+//JSpotmaster JSONマーシャリング構造体（versionはバージョン2以降のみ付ける）
+type JSpotmaster struct {
+	Version    int               `json:"version,omitempty"`
+	Spotmaster []InnerSpotmaster `json:"spotmaster"`
+}
+
+//RunParam スクレイピング実行パラメータ（実行ごとに独立させる）
+type RunParam struct {
+	City          City
+	Session       *Session
+	AreaIdString  string
+	SendAddress   string
+	Sinks         []Sink
+	Mode          string
+	MasterMode    string
+	MasterVersion int
+	//Cert 送信時に付ける証明書（空の場合は設定のapiCert）
+	Cert Secret
+	Job  *Job
+}
+
+//InnerSpotmaster スポット情報
+type InnerSpotmaster struct {
+	City string `json:"city"`
+	Area string `json:"area"`
+	Spot string `json:"spot"`
+	Name string `json:"name"`
+	Lat  string `json:"lat"`
+	Lon  string `json:"lon"`
+	//NameJa 日本語名, NameEn 英語名, NameEnSource 英語名の出所（バージョン2のみ）
+	NameJa       string `json:"nameJa,omitempty"`
+	NameEn       string `json:"nameEn,omitempty"`
+	NameEnSource string `json:"nameEnSource,omitempty"`
+}
+
+//////////////////////////////////////////////////////////////////////////////////////
+// レシーバ
+//////////////////////////////////////////////////////////////////////////////////////
+
+//Add SpotInfo構造体をJSON用にパースして加える
+func (s *JSpotinfo) Add(info SpotInfo) {
+	s.Spotinfo = append(s.Spotinfo, info.Inner())
+}
+
+//Size SpotInfo構造体のサイズを返す
+func (s *JSpotinfo) Size() int {
+	return len(s.Spotinfo)
+}
+
+//Add SpotInfo構造体をJSON用にパースして加える
+func (s *JSpotmaster) Add(info SpotInfo) {
+	s.Spotmaster = append(s.Spotmaster, info.InnerMaster().Versioned(s.Version))
+}
+
+//Size SpotInfo構造体のサイズを返す
+func (s *JSpotmaster) Size() int {
+	return len(s.Spotmaster)
+}
+
+//////////////////////////////////////////////////////////////////////////////////////
+// 関数
+//////////////////////////////////////////////////////////////////////////////////////
+
+//GetSessionID ログインしてセッションIDを取得する
+func GetSessionID(ctx context.Context, lg Logger, city City, userID string, password Secret) (string, error) {
+	lg = lg.With("member", userID, "city", city.Name)
+	//リプレイモードではログインしない
+	if replayDir() != "" {
+		return "replay", nil
+	}
+	//リクエストBody作成
+	values := url.Values{}
+	values.Set("EventNo", "21401")
+	values.Add("GarblePrevention", "ＰＯＳＴデータ")
+	values.Add("MemberID", userID)
+	values.Add("Password", password.Reveal())
+	values.Add("MemAreaID", city.MemAreaID)
+
+	req, err := http.NewRequestWithContext(
+		ctx,
+		"POST",
+		city.URL(),
+		strings.NewReader(values.Encode()),
+	)
+	if err != nil {
+		lg.Error("login request creation failed", "error", err)
+		metrics.Logins.Inc("failure")
+		return "", err
+	}
+
+	// リクエストHead作成
+	ContentLength := strconv.FormatInt(req.ContentLength, 10)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.9")
+	req.Header.Set("Accept-Encoding", "gzip, deflate, br")
+	req.Header.Set("Accept-Language", "ja,en-US;q=0.9,en;q=0.8,pt;q=0.7")
+	req.Header.Set("Cache-Control", "max-age=0")
+	req.Header.Set("Connection", "keep-alive")
+	req.Header.Set("Content-Length", ContentLength)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("Origin", req.URL.Scheme+"://"+req.URL.Host)
+	req.Header.Set("Referer", city.URL())
+	req.Header.Set("Sec-Fetch-Dest", "document")
+	req.Header.Set("Sec-Fetch-Mode", "navigate")
+	req.Header.Set("Sec-Fetch-Site", "same-origin")
+	req.Header.Set("Sec-Fetch-User", "?1")
+	req.Header.Set("Upgrade-Insecure-Requests", "1")
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/80.0.3987.106 Safari/537.36")
+
+	//ポータルへのリクエストはレート制限に従う
+	if err := portalLimiter.Wait(ctx); err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		lg.Error("login request failed", "error", err)
+		metrics.Logins.Inc("failure")
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	doc, e := goquery.NewDocumentFromResponse(resp)
+	if e != nil {
+		lg.Error("login response parse failed", "error", e)
+		metrics.Logins.Inc("failure")
+		return "", e
+	}
+
+	SessionID, success := doc.Find(parser.SessionID).Attr("value")
+	if !success {
+		lg.Error("login failed (session id not found)")
+		metrics.Logins.Inc("failure")
+		return "", fmt.Errorf("error")
+	} else {
+		lg.Info("login succeeded")
+		metrics.Logins.Inc("success")
+		metrics.LastSuccess.SetToNow("login")
+		//ログイン後のページからエリア一覧を取得する（取得できなければ設定の都市のareasを使う）
+		if err := areaCatalog.Update(lg, city, ParseAreaList(doc)); err != nil {
+			lg.Warn("area catalog save failed", "error", err)
+		}
+		//記録モードではログイン後のページも保存する（エリア選択の解析設定を確認するため）
+		if recordDir() != "" {
+			if err := SaveLoginPage(city, doc); err != nil {
+				lg.Warn("login page record failed", "error", err)
+			}
+		}
+		//成功したら待ち時間（1回目の検索に失敗するため）
+		if err := wait(ctx, loginWait); err != nil {
+			return "", err
+		}
+		return SessionID, nil
+	}
+}
+
+//GetSpotInfoMain スクレイピングメイン関数
+//1ページ（SpotPageSize件）で収まらないエリアはGetInfoTopNumをずらして全ページ取得し、エリア・スポットコードで重複を除く
+//検証エラーのスポットは除き、検証エラーとして返す
+func GetSpotInfoMain(ctx context.Context, lg Logger, session *Session, AreaID string, retry bool) ([]SpotInfo, []SpotError, error) {
+	lg.Debug("fetch spot list start", "retry", retry)
+	SessionID := session.ID()
+	var list []SpotInfo
+	var invalid []SpotError
+	seen := map[string]bool{}
+	pages := 0
+	for page := 1; ; page++ {
+		//リプレイモードでは保存済みのページを使う
+		var doc *goquery.Document
+		var err error
+		if replayDir() != "" {
+			doc, err = LoadSpotPage(session.City, AreaID, page)
+		} else {
+			doc, err = FetchSpotPage(ctx, lg, session.City, session.UserID, SessionID, AreaID, page)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		//保存済みのページがない（リプレイモードのみ）
+		if doc == nil {
+			break
+		}
+
+		//エラーならログインし直して再チャレンジ
+		if err := CheckErrorPage(doc); err != nil {
+			if retry {
+				lg.Warn("portal returned error page, relogin", "error", err, "page", page)
+				metrics.Relogins.Inc()
+				if _, err := session.Relogin(ctx, lg, SessionID); err != nil {
+					return nil, nil, err
+				}
+				//再帰呼び出し（次はリトライしない）
+				return GetSpotInfoMain(ctx, lg, session, AreaID, false)
+			} else {
+				//２回目は諦める
+				lg.Error("portal returned error page", "error", err, "page", page)
+				return nil, nil, err
+			}
+		}
+		pages = page
+
+		//スポットリスト解析（前のページと重複したスポットは除く）
+		entries := parser.SpotEntries(doc).Length()
+		added, duplicates := 0, 0
+		spots, errs := ParseSpotList(lg, doc)
+		invalid = append(invalid, errs...)
+		for _, s := range spots {
+			s.City = session.City.Name
+			key := s.Code()
+			if seen[key] {
+				duplicates++
+				continue
+			}
+			seen[key] = true
+			list = append(list, s)
+			added++
+		}
+		if duplicates > 0 {
+			metrics.SpotsSkipped.Add(float64(duplicates), "duplicate")
+		}
+		lg.Debug("spot page parsed", "page", page, "entries", entries, "added", added, "duplicates", duplicates)
+		if entries > SpotPageSize {
+			lg.Warn("spot page has more entries than requested", "page", page, "entries", entries, "requested", SpotPageSize)
+			metrics.PageAnomalies.Inc(session.City.Name, AreaID, "oversized")
+		}
+		//ページが埋まっていなければ最後のページ
+		if entries < SpotPageSize {
+			break
+		}
+		//ポータルがGetInfoTopNumを無視して同じページを返している
+		if added == 0 && duplicates > 0 {
+			lg.Warn("spot page has no new spots, stop paging", "page", page)
+			metrics.PageAnomalies.Inc(session.City.Name, AreaID, "repeated")
+			break
+		}
+		if page >= MaxSpotPages {
+			lg.Warn("spot page limit reached", "pages", page)
+			metrics.PageAnomalies.Inc(session.City.Name, AreaID, "limit")
+			break
+		}
+	}
+	spotPages.Observe(lg, session.City.Name, AreaID, pages)
+
+	lg.Info("fetch spot list done", "spots", len(list), "pages", pages, "invalid", len(invalid))
+	return list, invalid, nil
+}
+
+//SpotPageCounter エリアごとの前回のページ数（ページ数の変化を検知する）
+type SpotPageCounter struct {
+	mu    sync.Mutex
+	pages map[string]int
+}
+
+//spotPages エリアごとのページ数
+var spotPages = &SpotPageCounter{pages: map[string]int{}}
+
+//Observe ページ数を記録し、前回と変わった場合は警告する
+func (c *SpotPageCounter) Observe(lg Logger, city string, AreaID string, pages int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := cityKey(city, AreaID)
+	if last, exist := c.pages[key]; exist && last != pages {
+		lg.Warn("spot page count changed", "last", last, "pages", pages)
+		metrics.PageAnomalies.Inc(city, AreaID, "changed")
+	}
+	c.pages[key] = pages
+	metrics.SpotPages.Set(float64(pages), city, AreaID)
+}
+
+//FetchSpotPage ポータルからエリアのスポット一覧ページを取得する（記録モードではページを保存する）
+//pageは1から始まるページ番号
+func FetchSpotPage(ctx context.Context, lg Logger, city City, userID string, SessionID string, AreaID string, page int) (*goquery.Document, error) {
+	//リクエストBody作成
+	values := url.Values{}
+	values.Set("EventNo", "25706")
+	values.Add("SessionID", SessionID)
+	values.Add("UserID", city.Code)
+	values.Add("MemberID", userID)
+	values.Add("GetInfoNum", strconv.Itoa(SpotPageSize))
+	values.Add("GetInfoTopNum", strconv.Itoa((page-1)*SpotPageSize+1))
+	values.Add("MapType", "1")
+	values.Add("MapCenterLat", "")
+	values.Add("MapCenterLon", "")
+	values.Add("MapZoom", "13")
+	values.Add("EntServiceID", city.EntServiceID)
+	values.Add("Location", "")
+	values.Add("AreaID", AreaID)
+
+	req, err := http.NewRequestWithContext(
+		ctx,
+		"POST",
+		city.URL(),
+		strings.NewReader(values.Encode()),
+	)
+	if err != nil {
+		lg.Error("spot list request creation failed", "error", err)
+		return nil, err
+	}
+
+	// リクエストHead作成
+	ContentLength := strconv.FormatInt(req.ContentLength, 10)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.9")
+	req.Header.Set("Accept-Encoding", "gzip, deflate, br")
+	req.Header.Set("Accept-Language", "ja,en-US;q=0.9,en;q=0.8,pt;q=0.7")
+	req.Header.Set("Cache-Control", "max-age=0")
+	req.Header.Set("Connection", "keep-alive")
+	req.Header.Set("Content-Length", ContentLength)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("Origin", req.URL.Scheme+"://"+req.URL.Host)
+	req.Header.Set("Referer", city.URL())
+	req.Header.Set("Sec-Fetch-Dest", "document")
+	req.Header.Set("Sec-Fetch-Mode", "navigate")
+	req.Header.Set("Sec-Fetch-Site", "same-origin")
+	req.Header.Set("Sec-Fetch-User", "?1")
+	req.Header.Set("Upgrade-Insecure-Requests", "1")
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/80.0.3987.106 Safari/537.36")
+
+	//ポータルへのリクエストはレート制限に従う
+	if err := portalLimiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		lg.Error("spot list request failed", "error", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		lg.Error("spot list read failed", "error", err)
+		return nil, err
+	}
+	//記録モードではエリアごとにページを保存する
+	if recordDir() != "" {
+		if err := SaveSpotPage(city, AreaID, page, body); err != nil {
+			lg.Warn("spot page record failed", "error", err)
+		}
+	}
+
+	doc, e := goquery.NewDocumentFromReader(bytes.NewReader(body))
+	if e != nil {
+		lg.Error("spot list parse failed", "error", e)
+		return nil, e
+	}
+	return doc, nil
+}
+
+//ParseSpotList スポット一覧ページからスポット情報を取得する
+//解析できない・検証エラーのスポットは除き、検証エラーとして返す（メンテナンス中のスポットは除くだけ）
+func ParseSpotList(lg Logger, doc *goquery.Document) ([]SpotInfo, []SpotError) {
+	var list []SpotInfo
+	var invalid []SpotError
+	parser.SpotEntries(doc).Each(func(i int, s *goquery.Selection) {
+		spotinfo := SpotInfo{Time: time.Now()}
+		html, _ := s.Find(parser.SpotText).Html()
+		err := ParseSpotInfoByText(html, &spotinfo)
+		if err != nil {
+			//メンテナンス中のスポットのエラーログは出力しない
+			if strings.Index(err.Error(), "not cyclespot") < 0 {
+				lg.Warn("spot parse failed", "error", err)
+				metrics.SpotsSkipped.Inc("invalid")
+				invalid = append(invalid, SpotError{Area: spotinfo.Area, Spot: spotinfo.Spot, Field: "text", Value: html, Reason: "unparsable"})
+			} else {
+				metrics.SpotsSkipped.Inc("maintenance")
+			}
+			return
+		}
+		//緯度経度は両方ある場合のみ使う
+		lat, latExist := s.Find(parser.Lat).Attr("value")
+		lon, lonExist := s.Find(parser.Lon).Attr("value")
+		var errs []SpotError
+		if latExist && lonExist {
+			errs = spotinfo.SetLocation(lat, lon)
+		}
+		errs = append(errs, spotinfo.Validate()...)
+		if len(errs) > 0 {
+			for _, e := range errs {
+				lg.Warn("spot validation failed", "code", e.Area+"-"+e.Spot, "field", e.Field, "value", e.Value, "reason", e.Reason)
+			}
+			metrics.SpotsSkipped.Inc("invalid")
+			invalid = append(invalid, errs...)
+			return
+		}
+		list = append(list, spotinfo)
+	})
+	return list, invalid
+}
+
+//ParseSpotInfoByText テキスト解析
+// "H1-43.東京イースト21<br/>H1-43.Tokyo East 21<br/>13台"の形式のテキストからarea,spot,name,countを取得する
+//行の区切りやパターンは解析設定（parser）に従う
+func ParseSpotInfoByText(text string, s *SpotInfo) error {
+	return parser.ParseSpotText(text, s)
+}
+
+//RegAllSpotInfo 全スポット登録関数
+func RegAllSpotInfo(ctx context.Context, p RunParam) (err error) {
+	//同一アカウントの実行は直列化する（別アカウントは並行して動ける）
+	p.Session.run.Lock()
+	defer p.Session.run.Unlock()
+	p.Job.Start()
+	defer func() { p.Job.Finish(err) }()
+	//特に指定してない場合は都市の全エリア（ポータルから取得した一覧）
+	AreaIdString := p.AreaIdString
+	if AreaIdString == "" {
+		AreaIdString = areaCatalog.AreaIDs(p.City)
+	}
+	lg := p.Job.Logger().With("member", p.Session.UserID)
+	lg.Info("spot info run start", "areas", AreaIdString, "mode", p.Mode)
+	succeeded, err := ScrapeAreas(ctx, lg, p, strings.Split(AreaIdString, ","), func(ctx context.Context, alg Logger, r AreaScrape) {
+		AreaID, list := r.AreaID, r.List
+		//履歴に保存
+		if err := store.Save(list); err != nil {
+			alg.Error("history save failed", "error", err)
+		}
+		//差分送信モードでは台数が変わったスポットのみ送信する
+		key := SnapshotKey(p)
+		send, full := snapshot.Filter(key, AreaID, p.Mode, list)
+		areaKey := cityKey(p.City.Name, AreaID)
+		alg.Info("send spot info", "mode", p.Mode, "send", len(send), "spots", len(list))
+		//負荷緩和のため100件ずつ送信（最終送信台数は全シンクに出力できた分だけ更新する）
+		max := 100
+		var delivered, batch []SpotInfo
+		failed := false
+		flush := func() {
+			jsondata := JSpotinfo{}
+			for _, s := range batch {
+				jsondata.Add(s)
+			}
+			if err := SendToSinks(ctx, alg, p.Job, areaKey, p.Sinks, jsondata); err != nil {
+				failed = true
+			} else {
+				delivered = append(delivered, batch...)
+			}
+			batch = nil
+		}
+		for _, s := range send {
+			batch = append(batch, s)
+			if len(batch) >= max {
+				flush()
+				wait(ctx, time.Duration(config.RateLimit.BatchWait))
+			}
+		}
+		if len(batch) >= 1 {
+			flush()
+		}
+		snapshot.Commit(key, AreaID, delivered, full && !failed)
+		if err := snapshot.Save(); err != nil {
+			alg.Error("snapshot save failed", "error", err)
+		}
+	})
+	lg.Info("spot info run end", "succeeded", succeeded)
+	//全エリア失敗した場合のみエラーとする
+	if succeeded == 0 && err != nil {
+		return fmt.Errorf("all areas failed : %v", err)
+	}
+	return nil
+}
+
+//RegAllSpotMaster 全スポット登録関数（マスタメンテナンス）
+func RegAllSpotMaster(ctx context.Context, p RunParam) (err error) {
+	p.Session.run.Lock()
+	defer p.Session.run.Unlock()
+	p.Job.Start()
+	defer func() { p.Job.Finish(err) }()
+	lg := p.Job.Logger().With("member", p.Session.UserID)
+	lg.Info("spot master run start", "masterMode", p.MasterMode, "masterVersion", p.MasterVersion)
+	//マスタメンテでは都市の全エリア（ポータルから取得した一覧）を対象とする
+	succeeded, err := ScrapeAreas(ctx, lg, p, strings.Split(areaCatalog.AreaIDs(p.City), ","), func(ctx context.Context, alg Logger, r AreaScrape) {
+		AreaID, list := r.AreaID, r.List
+		//台数も取れているので履歴に保存
+		if err := store.Save(list); err != nil {
+			alg.Error("history save failed", "error", err)
+		}
+		//前回のマスタとの差分（追加・削除・名称変更・移設）
+		//スポットが取れなかった・急減したエリアは解析の失敗の可能性があるので比較せず、前回のマスタも更新しない
+		areaKey := cityKey(p.City.Name, AreaID)
+		var changes []MasterChange
+		if len(list) == 0 || r.Drifted {
+			alg.Warn("master diff skipped", "spots", len(list), "drift", r.Drifted)
+		} else {
+			changes = masterState.Diff(p.City.Name, AreaID, list, r.Invalid)
+			if err := masterState.Save(); err != nil {
+				alg.Error("master state save failed", "error", err)
+			}
+		}
+		if len(changes) > 0 && p.MasterMode != MasterFull {
+			alg.Info("send master changes", "changes", len(changes))
+			err := SendMasterChanges(ctx, alg, p.SendAddress, p.Cert, NewJMasterChanges(p.MasterVersion, changes), false)
+			p.Job.AddDelivery(NewDeliveryResult(areaKey, "http", len(changes), err))
+		}
+		if p.MasterMode == MasterChanges {
+			return
+		}
+		//負荷緩和のため100件ずつ送信
+		max := 100
+		jsondata := NewJSpotmaster(p.MasterVersion)
+		for _, s := range list {
+			jsondata.Add(s)
+			if jsondata.Size() >= max {
+				err := SendSpotMaster(ctx, alg, p.SendAddress, p.Cert, jsondata, false)
+				p.Job.AddDelivery(NewDeliveryResult(areaKey, "http", jsondata.Size(), err))
+				jsondata = NewJSpotmaster(p.MasterVersion)
+				wait(ctx, time.Duration(config.RateLimit.BatchWait))
+			}
+		}
+		if jsondata.Size() >= 1 {
+			err := SendSpotMaster(ctx, alg, p.SendAddress, p.Cert, jsondata, false)
+			p.Job.AddDelivery(NewDeliveryResult(areaKey, "http", jsondata.Size(), err))
+		}
+	})
+	lg.Info("spot master run end", "succeeded", succeeded)
+	//全エリア失敗した場合のみエラーとする
+	if succeeded == 0 && err != nil {
+		return fmt.Errorf("all areas failed : %v", err)
+	}
+	return nil
+}
+
+//AreaScrape エリアごとのスポット一覧の取得結果
+type AreaScrape struct {
+	AreaID string
+	List   []SpotInfo
+	//Invalid 検証エラーで除いたスポット
+	Invalid []SpotError
+	//Drifted スポット数がいつもより極端に少ない
+	Drifted bool
+}
+
+//ScrapeAreas エリアごとにスポット一覧を取得してhandleを呼ぶ。同時実行数は設定のrateLimit.concurrencyまで
+//ポータルへのリクエストは共有のレート制限に従い、エリアごとにrateLimit.areaTimeoutで打ち切る
+//成功したエリア数と最後のエラーを返す
+func ScrapeAreas(ctx context.Context, lg Logger, p RunParam, AreaIDs []string, handle func(ctx context.Context, alg Logger, r AreaScrape)) (int, error) {
+	concurrency := config.RateLimit.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		succeeded int
+		lastErr   error
+	)
+	sem := make(chan struct{}, concurrency)
+	for _, AreaID := range AreaIDs {
+		if AreaID == "" {
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		//キャンセルされた場合は残りのエリアを実行しない
+		if ctx.Err() != nil {
+			p.Job.AddArea(cityKey(p.City.Name, AreaID), 0, ctx.Err())
+			mu.Lock()
+			lastErr = ctx.Err()
+			mu.Unlock()
+			continue
+		}
+		wg.Add(1)
+		go func(AreaID string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			alg := lg.With("city", p.City.Name, "area", AreaID)
+			areaKey := cityKey(p.City.Name, AreaID)
+			actx, cancel := context.WithTimeout(ctx, time.Duration(config.RateLimit.AreaTimeout))
+			defer cancel()
+			//台数取得
+			started := time.Now()
+			list, invalid, err := GetSpotInfoMain(actx, alg, p.Session, AreaID, true)
+			metrics.ObserveScrape(p.City.Name, AreaID, time.Since(started), len(list), err)
+			health.ObserveScrape(areaKey, err)
+			p.Job.AddArea(areaKey, len(list), err)
+			p.Job.AddSpotErrors(invalid)
+			if err != nil {
+				alg.Error("fetch spot list failed", "error", err)
+				mu.Lock()
+				lastErr = err
+				mu.Unlock()
+				return
+			}
+			//いつもより極端に少ない場合は解析できなくなった可能性があるので通知する
+			drifted := drift.Observe(alg, p.City.Name, AreaID, len(list))
+			mu.Lock()
+			succeeded++
+			mu.Unlock()
+			handle(ctx, alg, AreaScrape{AreaID: AreaID, List: list, Invalid: invalid, Drifted: drifted})
+		}(AreaID)
+	}
+	wg.Wait()
+	return succeeded, lastErr
+}
+
+//CheckErrorPage エラーページかをチェックする
+func CheckErrorPage(doc *goquery.Document) error {
+	if message, isError := parser.IsErrorPage(doc); isError {
+		return fmt.Errorf("%s", message)
+	}
+	return nil
+}
+
+//SendSpotInfo DBに送信する。JSONファイルからのリカバリの場合は失敗したらJSONを保存しないフラグ（第３引数）
+//保存した場合はSpooledErrorを返す
+func SendSpotInfo(ctx context.Context, lg Logger, address string, cert Secret, jsonStruct JSpotinfo, fromRecovery bool) error {
+	return postJSON(ctx, lg, "SendSpotInfo", SpoolTypeSpotinfo, address, cert, jsonStruct, fromRecovery)
+}
+
+//SendSpotMaster マスタ情報をDBに送信する。リカバリからの場合は失敗したらJSONを保存しないフラグ（第３引数）
+//保存した場合はSpooledErrorを返す
+func SendSpotMaster(ctx context.Context, lg Logger, address string, cert Secret, jsonStruct JSpotmaster, fromRecovery bool) error {
+	return postJSON(ctx, lg, "SendSpotMaster", SpoolTypeSpotmaster, address, cert, jsonStruct, fromRecovery)
+}
+
+//postJSON JSONをPOSTする。失敗した場合はfromRecoveryでなければスプールに保存してSpooledErrorを返す
+//キャンセル済みのctxでは送信せずにスプールに保存する（終了時に未送信のデータを失わないため）
+//certが空の場合は設定のapiCertを付ける
+func postJSON(ctx context.Context, lg Logger, name string, dataType string, address string, cert Secret, jsonStruct interface{}, fromRecovery bool) error {
+	lg = lg.With("call", name, "type", dataType)
+	marshalized, _ := json.Marshal(jsonStruct)
+	req, err := http.NewRequestWithContext(
+		ctx,
+		"POST",
+		address,
+		bytes.NewBuffer(marshalized),
+	)
+	if err != nil {
+		lg.Error("delivery request creation failed", "error", err)
+		return err
+	}
+
+	// リクエストHead作成
+	ContentLength := strconv.FormatInt(req.ContentLength, 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Length", ContentLength)
+	if cert.Empty() {
+		cert = config.APICert
+	}
+	req.Header.Set("cert", cert.Reveal())
+
+	//送信
+	resp, err := client.Do(req)
+	if err != nil {
+		lg.Error("delivery failed", "error", err)
+		if !fromRecovery {
+			if id, e := spool.Put(address, cert, dataType, jsonStruct, err); e == nil {
+				lg.Warn("delivery spooled", "spool", id)
+				metrics.Spooled.Inc(dataType)
+				return &SpooledError{Err: err, ID: id}
+			}
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		lg.Error("delivery failed", "status", resp.StatusCode)
+		err := fmt.Errorf("StatusCode is not OK : %d", resp.StatusCode)
+		if !fromRecovery {
+			if id, e := spool.Put(address, cert, dataType, jsonStruct, err); e == nil {
+				lg.Warn("delivery spooled", "spool", id)
+				metrics.Spooled.Inc(dataType)
+				return &SpooledError{Err: err, ID: id}
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+//PrepareScrayping スクレイピング準備（返り値のcancelがtrueの場合は実行しない）。kindはcountsまたはmaster
+//通常はprofileで指定したプロファイルの設定で実行する。クエリパラメータのid, passwordは設定で許可した場合のみ受け付ける
+func PrepareScrayping(w rest.ResponseWriter, r *rest.Request, kind string) (p RunParam, cancel bool) {
+	//パラメータ解析
+	r.ParseForm()
+	params := r.Form
+	var prof Profile
+	if params.Get("id") != "" || params.Get("password") != "" {
+		if !config.AllowQueryCredentials {
+			w.WriteHeader(http.StatusForbidden)
+			w.WriteJson("[ERROR] query credentials are disabled")
+			return p, true
+		}
+		//従来の方式（全てクエリパラメータで指定する）
+		prof = Profile{
+			City:          params.Get("city"),
+			ID:            params.Get("id"),
+			Password:      NewSecret(params.Get("password")),
+			Address:       params.Get("address"),
+			AreaID:        params.Get("areaID"),
+			Sink:          params.Get("sink"),
+			Mode:          params.Get("mode"),
+			MasterMode:    params.Get("masterMode"),
+			MasterVersion: params.Get("masterVersion"),
+			//送信時の証明書はこの実行のみに使う（他の実行やリカバリの証明書は変えない）
+			APICert: NewSecret(params.Get("env")),
+		}
+	} else {
+		var err error
+		if prof, err = config.Profile(params.Get("profile")); err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.WriteJson("[ERROR] " + err.Error())
+			return p, true
+		}
+	}
+	var err error
+	if p, err = prof.RunParam(kind); err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		w.WriteJson("[ERROR] " + err.Error())
+		return p, true
+	}
+	//同一アカウントの連続実行を禁止する（ポータルにアクセスする前に判定する）
+	lg := logger.With("member", prof.ID)
+	session := sessions.Lookup(p.City, prof.ID)
+	if !session.CheckInterval() {
+		lg.Warn("request canceled (requested again within minimum interval)")
+		w.WriteHeader(http.StatusOK)
+		w.WriteJson("scraping canceled")
+		return p, true
+	}
+	//セッションIDはアカウントごとに使いまわす（未ログインやパスワード変更時はログインし直し）
+	if err := session.Login(r.Context(), lg, prof.Password); err != nil {
+		lg.Error("login failed", "error", err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.WriteJson("login failed")
+		return p, true
+	}
+	lastExcuted = time.Now().Unix()
+	//リカバリ時の送信先は最後に指定されたアドレスとする
+	if p.SendAddress != "" {
+		SendAddress = p.SendAddress
+	}
+	p.Session = session
+	return p, false
+}
+
+//Start スクレイピング開始
+func Start(w rest.ResponseWriter, r *rest.Request) {
+	//チェック＆初期化
+	p, cancel := PrepareScrayping(w, r, "counts")
+	if cancel {
+		return
+	}
+	//スクレイピング実行（非同期）
+	p.Job = jobs.New("counts", "api", p.Session.UserID)
+	go RegAllSpotInfo(p.Job.Context(), p)
+	//先にOKを返しておく（結果は/jobs/{id}で確認する）
+	w.WriteHeader(http.StatusOK)
+	w.WriteJson(map[string]string{"result": "OK", "job": p.Job.ID()})
+}
+
+//StartMaster スクレイピング開始
+func StartMaster(w rest.ResponseWriter, r *rest.Request) {
+	//チェック＆初期化
+	p, cancel := PrepareScrayping(w, r, "master")
+	if cancel {
+		return
+	}
+	//スクレイピング実行（非同期）
+	p.Job = jobs.New("master", "api", p.Session.UserID)
+	go RegAllSpotMaster(p.Job.Context(), p)
+	//先にOKを返しておく（結果は/jobs/{id}で確認する）
+	w.WriteHeader(http.StatusOK)
+	w.WriteJson(map[string]string{"result": "OK", "job": p.Job.ID()})
+}
+
+//InitClient クライアント初期化
+func InitClient() {
+	//SSL証明書を無視したクライアント作成
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	client = &http.Client{
+		Transport: tr,
+		Timeout:   HTTPTimeout,
+	}
+}
+
+//Recover スプールからリカバリー
+func Recover(w rest.ResponseWriter, r *rest.Request) {
+	//パラメータ解析
+	r.ParseForm()
+	params := r.Form
+	//最大件数
+	max := 5
+	if param := params.Get("max"); param != "" {
+		if val, err := strconv.Atoi(param); err == nil {
+			max = val
+		}
+	}
+	//max=0のときは件数確認のみのためチェックしない
+	if max > 0 {
+		if !initialized() {
+			logger.Warn("recovery canceled (not initialized)")
+			w.WriteHeader(http.StatusOK)
+			w.WriteJson("recovery canceled")
+			return
+		}
+		//連続実行を禁止する
+		if now := time.Now().Unix(); now-lastRecovered < int64(time.Duration(config.RateLimit.MinInterval).Seconds()) {
+			logger.Warn("recovery canceled (requested again within minimum interval)")
+			w.WriteHeader(http.StatusOK)
+			w.WriteJson("recovery canceled")
+			return
+		}
+		lastRecovered = time.Now().Unix()
+	}
+
+	//スプールのエントリ数
+	pending := spool.Depth(SpoolPending)
+	if pending < 1 {
+		logger.Info("no spool entries")
+		w.WriteHeader(http.StatusOK)
+		w.WriteJson("no recovery cache found")
+		return
+	} else if max == 0 {
+		msg := fmt.Sprintf("%d entries found (dead letter : %d) \n", pending, spool.Depth(SpoolDead))
+		logger.Info("spool entries found", "pending", pending, "dead", spool.Depth(SpoolDead))
+		w.WriteHeader(http.StatusOK)
+		w.WriteJson(msg)
+		return
+	}
+	//再送時刻を待たずに送信する（非同期。結果は/jobs/{id}で確認する）
+	job := jobs.New("recover", "api", "")
+	go spool.Drain(job, max, true)
+	w.WriteHeader(http.StatusOK)
+	w.WriteJson(map[string]string{"result": "OK", "job": job.ID()})
+}
+
+func main() {
+	//設定ファイル用にパスワードを暗号化する
+	if len(os.Args) > 1 && os.Args[1] == "encrypt" {
+		if err := EncryptCommand(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	//設定ファイルと環境変数
+	c, err := LoadConfig(os.Getenv("CONFIG_PATH"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	config = c
+	portalLimiter = NewTokenBucket(config.RateLimit.PortalRate, config.RateLimit.PortalBurst)
+	if parser, err = config.Parser.Compile(); err != nil {
+		log.Fatal(err)
+	}
+	if !config.Auth.Enabled() {
+		if config.Auth.Disabled {
+			logger.Warn("authentication is disabled (AUTH_DISABLED)")
+		} else {
+			logger.Warn("authentication is not configured, only read endpoints are allowed")
+		}
+	}
+
+	api := rest.NewApi()
+	api.Use(AccessLogStack()...)
+	api.Use(&AuthMiddleware{Config: config.Auth})
+	router, err := rest.MakeRouter(
+		rest.Get("/start", Start),
+		rest.Get("/master", StartMaster),
+		rest.Get("/recover", Recover),
+		rest.Get("/spots/:area/:spot/history", GetSpotHistory),
+		rest.Get("/master/changes", GetMasterChanges),
+		rest.Get("/areas", GetAreas),
+		rest.Get("/jobs", GetJobs),
+		rest.Get("/jobs/:id", GetJob),
+		rest.Post("/jobs/:id/cancel", CancelJob),
+		rest.Get("/spool", GetSpool),
+		rest.Delete("/spool", PurgeSpool),
+		rest.Get("/spool/:id", GetSpoolEntry),
+		rest.Post("/spool/:id/retry", RetrySpoolEntry),
+		rest.Delete("/spool/:id", DeleteSpoolEntry),
+		rest.Get("/schedules", GetSchedules),
+		rest.Get("/metrics", GetMetrics),
+		rest.Get("/healthz", GetHealthz),
+		rest.Get("/readyz", GetReadyz),
+		rest.Post("/credentials/:profile", RotateCredentials),
+		rest.Post("/schedules/:name/enable", EnableSchedule),
+		rest.Post("/schedules/:name/disable", DisableSchedule),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+	api.SetApp(router)
+	port := "5005"
+	if val := os.Getenv("PORT"); val != "" {
+		port = val
+	}
+	InitClient()
+	if val := os.Getenv("PORTAL_BASE_URL"); val != "" {
+		PortalBaseURL = val
+	}
+	//定期実行スケジュール
+	if err := scheduler.LoadSchedules(config.Schedules); err != nil {
+		log.Fatal(err)
+	}
+	scheduler.Start()
+	//リカバリ用スプール（旧形式のファイルを取り込んでから自動再送を開始する）
+	spool.ImportLegacy()
+	spool.StartDrainer(time.Minute)
+	//SIGTERMで実行中のジョブを止めてから終了する
+	if err := Serve(&http.Server{Addr: ":" + port, Handler: api.MakeHandler()}); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,812 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/ant0ine/go-json-rest/rest"
+)
+
+//TestMain ログを捨て、保存先をテスト用の一時フォルダにする（疑似ポータル向けに待ち時間はなくす）
+func TestMain(m *testing.M) {
+	logOutput = ioutil.Discard
+	loginWait = 0
+	portalLimiter = NewTokenBucket(1000, 1000)
+	config.RateLimit.BatchWait = 0
+	dir, err := ioutil.TempDir("", "heroku_scraper_test")
+	if err != nil {
+		panic(err)
+	}
+	store = NewSpotStore(filepath.Join(dir, "spotstore"))
+	spool = NewSpool(filepath.Join(dir, "spool"), spoolMaxAttempts())
+	snapshot = NewSnapshot(filepath.Join(dir, "snapshot.json"))
+	masterState = NewMasterState(filepath.Join(dir, "master.json"))
+	areaCatalog = NewAreaCatalog(filepath.Join(dir, "areas.json"))
+	InitClient()
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+//setenv テストの間だけ環境変数を設定する（戻す関数を返す）
+func setenv(key string, value string) func() {
+	old, exist := os.LookupEnv(key)
+	os.Setenv(key, value)
+	return func() {
+		if exist {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+//loadPage 保存済みのページを読み込む
+func loadPage(t *testing.T, name string) *goquery.Document {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", "replay", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	doc, err := goquery.NewDocumentFromReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestParseSpotInfoByText(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		want    SpotInfo
+		wantErr string
+	}{
+		{name: "br", text: "H1-43.東京イースト21<br>H1-43.Tokyo East 21<br>13台",
+			want: SpotInfo{SpotCode: SpotCode{Area: "H1", Spot: "43"}, NameJa: "東京イースト21", NameEn: "Tokyo East 21", Count: 13}},
+		{name: "br slash", text: "H1-43.東京イースト21<br/>H1-43.Tokyo East 21<br/>13台",
+			want: SpotInfo{SpotCode: SpotCode{Area: "H1", Spot: "43"}, NameJa: "東京イースト21", NameEn: "Tokyo East 21", Count: 13}},
+		{name: "br space slash", text: "H1-43.東京イースト21<br />H1-43.Tokyo East 21<br />13台",
+			want: SpotInfo{SpotCode: SpotCode{Area: "H1", Spot: "43"}, NameJa: "東京イースト21", NameEn: "Tokyo East 21", Count: 13}},
+		{name: "upper case br", text: "H1-43.東京イースト21<BR>H1-43.Tokyo East 21<BR>13台",
+			want: SpotInfo{SpotCode: SpotCode{Area: "H1", Spot: "43"}, NameJa: "東京イースト21", NameEn: "Tokyo East 21", Count: 13}},
+		{name: "newlines and spaces", text: "\n\t H1-43. 東京イースト21&nbsp;<br>\n H1-43.Tokyo East 21 <br>\n 13 台 \n",
+			want: SpotInfo{SpotCode: SpotCode{Area: "H1", Spot: "43"}, NameJa: "東京イースト21", NameEn: "Tokyo East 21", Count: 13}},
+		{name: "no english line", text: "H1-01.木場公園<br>0台",
+			want: SpotInfo{SpotCode: SpotCode{Area: "H1", Spot: "01"}, NameJa: "木場公園", Count: 0}},
+		{name: "english same as japanese", text: "A1-01.KITTE<br>A1-01.KITTE<br>2台",
+			want: SpotInfo{SpotCode: SpotCode{Area: "A1", Spot: "01"}, NameJa: "KITTE", Count: 2}},
+		{name: "maintenance", text: "メンテナンス中<br>Under maintenance<br>0台", wantErr: "not cyclespot"},
+		{name: "single line", text: "H1-43.東京イースト21", wantErr: "unexpected html"},
+		{name: "no count", text: "H1-43.東京イースト21<br>H1-43.Tokyo East 21<br>台数不明", wantErr: "count not obtained"},
+		{name: "bad code", text: "H1_43.東京イースト21<br>13台", wantErr: "unexpected code"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got SpotInfo
+			err := ParseSpotInfoByText(tt.text, &got)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSpotList(t *testing.T) {
+	tests := []struct {
+		page string
+		//want "エリア-スポット 日本語名/英語名 台数 緯度,経度"
+		want []string
+		//wantInvalid "エリア-スポット 項目"
+		wantInvalid []string
+	}{
+		{page: "1.html", want: []string{
+			"H1-43 東京イースト21/Tokyo East 21 13 35.6666,139.8129",
+			"H1-01 木場公園/Kiba Park 7 35.6727,139.817",
+		}},
+		{page: "5.html", want: []string{
+			"I1-01 渋谷駅東口/Shibuya Sta. East Exit 9 35.658,139.7016",
+			"I1-02 宮下公園/Miyashita Park 12 35.6612,139.704",
+			"I1-03 代々木公園/ 0 35.664,139.6982",
+			"I1-04 恵比寿ガーデンプレイス/Yebisu Garden Place 3 -",
+		}, wantInvalid: []string{"I1-05 lat", "I1-06 count", "I1-07 text"}},
+		{page: "99.html"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.page, func(t *testing.T) {
+			list, invalid := ParseSpotList(logger, loadPage(t, tt.page))
+			var got []string
+			for _, s := range list {
+				location := "-"
+				if s.HasLocation {
+					location = formatCoord(s.Lat) + "," + formatCoord(s.Lon)
+				}
+				got = append(got, s.Code()+" "+s.NameJa+"/"+s.NameEn+" "+strconv.Itoa(s.Count)+" "+location)
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("spots\ngot:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+			var gotInvalid []string
+			for _, e := range invalid {
+				gotInvalid = append(gotInvalid, e.Area+"-"+e.Spot+" "+e.Field)
+			}
+			if strings.Join(gotInvalid, ",") != strings.Join(tt.wantInvalid, ",") {
+				t.Errorf("invalid = %v, want %v", gotInvalid, tt.wantInvalid)
+			}
+		})
+	}
+}
+
+func TestCheckErrorPage(t *testing.T) {
+	tests := []struct {
+		page    string
+		wantErr string
+	}{
+		{page: "1.html"},
+		{page: "4_2.html"},
+		{page: "99.html", wantErr: "セッションの有効期限が切れました。再度ログインしてください。"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.page, func(t *testing.T) {
+			err := CheckErrorPage(loadPage(t, tt.page))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error : %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGetSpotInfoMainReplay(t *testing.T) {
+	defer setenv("REPLAY_DIR", filepath.Join("testdata", "replay"))()
+	city, err := NewConfig().City("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		areaID    string
+		wantSpots int
+		wantErr   bool
+	}{
+		//1ページのみ
+		{areaID: "1", wantSpots: 2},
+		//2ページ（2ページ目の先頭は1ページ目の最後と重複する）
+		{areaID: "4", wantSpots: 214},
+		//エラーページ（リトライしない）
+		{areaID: "99", wantErr: true},
+		//保存済みのページがない
+		{areaID: "404", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.areaID, func(t *testing.T) {
+			session := &Session{City: city, UserID: "test"}
+			list, _, err := GetSpotInfoMain(context.Background(), logger, session, tt.areaID, false)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(list) != tt.wantSpots {
+				t.Errorf("spots = %d, want %d", len(list), tt.wantSpots)
+			}
+			seen := map[string]bool{}
+			for _, s := range list {
+				if seen[s.Code()] {
+					t.Errorf("duplicate spot %s", s.Code())
+				}
+				seen[s.Code()] = true
+				if s.City != city.Name {
+					t.Errorf("city = %q, want %q", s.City, city.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadSpotPage(t *testing.T) {
+	defer setenv("REPLAY_DIR", filepath.Join("testdata", "replay"))()
+	city, _ := NewConfig().City("")
+	tests := []struct {
+		areaID      string
+		page        int
+		wantEntries int
+		wantNil     bool
+		wantErr     bool
+	}{
+		{areaID: "4", page: 1, wantEntries: 200},
+		{areaID: "4", page: 2, wantEntries: 16},
+		//2ページ目以降がない場合は最後のページ
+		{areaID: "4", page: 3, wantNil: true},
+		{areaID: "1", page: 2, wantNil: true},
+		//1ページ目がない場合はエラー
+		{areaID: "404", page: 1, wantErr: true},
+		//パスに使えないエリアID
+		{areaID: "../1", page: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		doc, err := LoadSpotPage(city, tt.areaID, tt.page)
+		switch {
+		case tt.wantErr:
+			if err == nil {
+				t.Errorf("%s page %d : expected error", tt.areaID, tt.page)
+			}
+		case err != nil:
+			t.Errorf("%s page %d : %v", tt.areaID, tt.page, err)
+		case tt.wantNil:
+			if doc != nil {
+				t.Errorf("%s page %d : expected no page", tt.areaID, tt.page)
+			}
+		case doc == nil:
+			t.Errorf("%s page %d : page not loaded", tt.areaID, tt.page)
+		default:
+			if n := parser.SpotEntries(doc).Length(); n != tt.wantEntries {
+				t.Errorf("%s page %d : entries = %d, want %d", tt.areaID, tt.page, n, tt.wantEntries)
+			}
+		}
+	}
+}
+
+func TestPostJSONCert(t *testing.T) {
+	defer setenv("CREDENTIALS_KEY", "test")()
+	var mu sync.Mutex
+	var got []string
+	status := http.StatusInternalServerError
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, r.Header.Get("cert"))
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	old := config.APICert
+	config.APICert = NewSecret("global")
+	defer func() { config.APICert = old }()
+
+	ctx := context.Background()
+	jsondata := JSpotinfo{}
+	jsondata.Add(SpotInfo{SpotCode: SpotCode{Area: "H1", Spot: "01"}, NameJa: "木場公園", Count: 1})
+	//実行ごとの証明書で送信し、失敗したらスプールに証明書ごと保存する
+	err := SendSpotInfo(ctx, logger, srv.URL, NewSecret("run"), jsondata, false)
+	var spooled *SpooledError
+	if !errors.As(err, &spooled) {
+		t.Fatalf("error = %v, want spooled", err)
+	}
+	//設定のapiCertは変わらない
+	if err := SendSpotInfo(ctx, logger, srv.URL, Secret{}, jsondata, true); err == nil {
+		t.Fatal("expected error")
+	}
+	if config.APICert.Reveal() != "global" {
+		t.Errorf("global cert changed")
+	}
+	//再送時も保存した証明書を使う
+	mu.Lock()
+	status = http.StatusOK
+	mu.Unlock()
+	if _, err := spool.Retry(jobs.New("recover", "test", ""), spooled.ID); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"run", "global", "run"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("cert headers = %v, want %v", got, want)
+	}
+}
+
+func TestAuthNotConfigured(t *testing.T) {
+	ok := func(w rest.ResponseWriter, r *rest.Request) { w.WriteJson("ok") }
+	tests := []struct {
+		method string
+		path   string
+		//want 認証未設定の場合, wantDisabled AUTH_DISABLEDの場合
+		want         int
+		wantDisabled int
+	}{
+		{method: "GET", path: "/healthz", want: http.StatusOK, wantDisabled: http.StatusOK},
+		{method: "GET", path: "/jobs", want: http.StatusOK, wantDisabled: http.StatusOK},
+		{method: "GET", path: "/spool", want: http.StatusForbidden, wantDisabled: http.StatusOK},
+		{method: "GET", path: "/spool/1-ab", want: http.StatusForbidden, wantDisabled: http.StatusOK},
+		{method: "GET", path: "/start", want: http.StatusForbidden, wantDisabled: http.StatusOK},
+		{method: "GET", path: "/master", want: http.StatusForbidden, wantDisabled: http.StatusOK},
+		{method: "GET", path: "/recover", want: http.StatusForbidden, wantDisabled: http.StatusOK},
+		{method: "DELETE", path: "/spool", want: http.StatusForbidden, wantDisabled: http.StatusOK},
+		{method: "POST", path: "/credentials/default", want: http.StatusForbidden, wantDisabled: http.StatusOK},
+		{method: "POST", path: "/jobs/x/cancel", want: http.StatusForbidden, wantDisabled: http.StatusOK},
+		{method: "POST", path: "/schedules/counts/disable", want: http.StatusForbidden, wantDisabled: http.StatusOK},
+	}
+	for _, disabled := range []bool{false, true} {
+		api := rest.NewApi()
+		api.Use(&AuthMiddleware{Config: AuthConfig{Disabled: disabled}})
+		router, err := rest.MakeRouter(
+			rest.Get("/healthz", ok),
+			rest.Get("/jobs", ok),
+			rest.Get("/spool", ok),
+			rest.Get("/spool/:id", ok),
+			rest.Get("/start", ok),
+			rest.Get("/master", ok),
+			rest.Get("/recover", ok),
+			rest.Delete("/spool", ok),
+			rest.Post("/credentials/:profile", ok),
+			rest.Post("/jobs/:id/cancel", ok),
+			rest.Post("/schedules/:name/disable", ok),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		api.SetApp(router)
+		srv := httptest.NewServer(api.MakeHandler())
+		for _, tt := range tests {
+			req, _ := http.NewRequest(tt.method, srv.URL+tt.path, nil)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			want := tt.want
+			if disabled {
+				want = tt.wantDisabled
+			}
+			if resp.StatusCode != want {
+				t.Errorf("disabled=%v %s %s : status = %d, want %d", disabled, tt.method, tt.path, resp.StatusCode, want)
+			}
+		}
+		srv.Close()
+	}
+}
+
+func TestSpoolDrainCanceled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "heroku_scraper_spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	received := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		select {
+		case received <- struct{}{}:
+		default:
+		}
+		//応答しない送信先（キャンセルされるまで待つ）
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	s := NewSpool(dir, 10)
+	id, err := s.Put(srv.URL, Secret{}, SpoolTypeSpotinfo, JSpotinfo{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	before, _ := s.find(id)
+	s.mu.Unlock()
+	job := jobs.New("recover", "test", "")
+	go func() {
+		<-received
+		job.Cancel()
+	}()
+	s.Drain(job, 10, true)
+	//キャンセルされた送信は送信回数・再送時刻を変えずにpendingのまま残す
+	s.mu.Lock()
+	after, err := s.find(id)
+	s.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.State != SpoolPending || after.Attempts != before.Attempts || after.NextRetry != before.NextRetry {
+		t.Errorf("entry changed : before %+v, after %+v", before, after)
+	}
+}
+
+func TestSpoolDrainDue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "heroku_scraper_spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	s := NewSpool(dir, 10)
+	id, err := s.Put(srv.URL, Secret{}, SpoolTypeSpotinfo, JSpotinfo{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := len(jobs.List())
+	//再送時刻前のエントリしかない場合はジョブを作らない
+	if job := s.drainDue(20); job != nil {
+		t.Errorf("job created before retry time : %s", job.ID())
+	}
+	s.mu.Lock()
+	e, _ := s.find(id)
+	e.NextRetry = time.Now().Add(-time.Minute).Format(TimeLayout)
+	s.write(e)
+	s.sending[id] = true
+	s.mu.Unlock()
+	//他の再送で送信中の場合もジョブを作らない
+	if job := s.drainDue(20); job != nil {
+		t.Errorf("job created while sending : %s", job.ID())
+	}
+	if after := len(jobs.List()); after != before {
+		t.Errorf("jobs = %d, want %d", after, before)
+	}
+	s.release([]*SpoolEntry{e})
+	job := s.drainDue(20)
+	if job == nil {
+		t.Fatal("no job for due entry")
+	}
+	if got := len(job.Status().Deliveries); got != 1 {
+		t.Errorf("deliveries = %d, want 1", got)
+	}
+	if s.Depth(SpoolPending) != 0 {
+		t.Errorf("entry not removed")
+	}
+}
+
+func TestParseAreaList(t *testing.T) {
+	areas := ParseAreaList(loadPage(t, "login.html"))
+	var got []string
+	for _, a := range areas {
+		got = append(got, a.ID+":"+a.Name)
+	}
+	want := "1:千代田区,2:中央区,3:港区,5:新宿区,6:文京区,4:江東区,10:渋谷区,12:品川区,7:目黒区,8:大田区"
+	if strings.Join(got, ",") != want {
+		t.Errorf("areas = %s, want %s", strings.Join(got, ","), want)
+	}
+	//エリア選択がないページ
+	if areas := ParseAreaList(loadPage(t, "1.html")); len(areas) != 0 {
+		t.Errorf("areas = %v, want none", areas)
+	}
+}
+
+func TestAreaCatalogUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "heroku_scraper_areas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	city, _ := NewConfig().City("")
+	areas := func(ids string) []Area {
+		list := []Area{}
+		for _, id := range strings.Split(ids, ",") {
+			if id != "" {
+				list = append(list, Area{ID: id})
+			}
+		}
+		return list
+	}
+	c := NewAreaCatalog(filepath.Join(dir, "areas.json"))
+	tests := []struct {
+		name       string
+		discovered string
+		wantSource string
+		wantIDs    string
+	}{
+		//設定の都市のareasと比べる
+		{name: "too different from config", discovered: "1,90,91,92,93", wantSource: "config", wantIDs: "1,2,3,5,6,4,10,12,7,8"},
+		{name: "similar to config", discovered: "1,2,3,5,6,4,10,12,7,8,13", wantSource: "discovered", wantIDs: "1,2,3,5,6,4,10,12,7,8,13"},
+		//前回取得した一覧と比べる
+		{name: "one area removed", discovered: "1,2,3,5,6,4,10,12,7,13", wantSource: "discovered", wantIDs: "1,2,3,5,6,4,10,12,7,13"},
+		{name: "not found", discovered: "", wantSource: "config", wantIDs: "1,2,3,5,6,4,10,12,7,8"},
+		{name: "most areas removed", discovered: "1,2,3", wantSource: "config", wantIDs: "1,2,3,5,6,4,10,12,7,8"},
+		{name: "recovered", discovered: "1,2,3,5,6,4,10,12,7,13", wantSource: "discovered", wantIDs: "1,2,3,5,6,4,10,12,7,13"},
+	}
+	for _, tt := range tests {
+		if err := c.Update(logger, city, areas(tt.discovered)); err != nil {
+			t.Fatal(err)
+		}
+		got := c.Get(city)
+		if got.Source != tt.wantSource || strings.Join(areaIDs(got.Areas), ",") != tt.wantIDs {
+			t.Errorf("%s : got %s %v, want %s %s", tt.name, got.Source, areaIDs(got.Areas), tt.wantSource, tt.wantIDs)
+		}
+		if (got.Source == "config") != (got.Fallback != "") {
+			t.Errorf("%s : fallback = %q", tt.name, got.Fallback)
+		}
+	}
+	//保存したファイルから読み込んでも同じ
+	if got := NewAreaCatalog(filepath.Join(dir, "areas.json")).AreaIDs(city); got != "1,2,3,5,6,4,10,12,7,13" {
+		t.Errorf("reloaded areas = %s", got)
+	}
+}
+
+func TestRomanize(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+		ok   bool
+	}{
+		{text: "ヒルズ", want: "Hiruzu", ok: true},
+		{text: "とうきょう", want: "Toukyou", ok: true},
+		{text: "キッテ・マルノウチ", want: "Kitte Marunouchi", ok: true},
+		{text: "マッチャ", want: "Matcha", ok: true},
+		{text: "ファミリーマート", want: "Famirimato", ok: true},
+		{text: "ＫＩＴＴＥ　２", want: "KITTE 2", ok: true},
+		//漢字は読みがわからないので変換しない（一部だけ変換した名前も返さない）
+		{text: "木場公園", ok: false},
+		{text: "東京イースト21", ok: false},
+	}
+	for _, tt := range tests {
+		got, ok := Romanize(tt.text)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("Romanize(%q) = %q, %v, want %q, %v", tt.text, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestInnerMasterNameEn(t *testing.T) {
+	tests := []struct {
+		name    string
+		spot    SpotInfo
+		version int
+		want    string
+	}{
+		{name: "portal", spot: SpotInfo{NameJa: "東京イースト21", NameEn: "Tokyo East 21"}, version: MasterVersion2,
+			want: `"nameJa":"東京イースト21","nameEn":"Tokyo East 21","nameEnSource":"portal"`},
+		{name: "romanized", spot: SpotInfo{NameJa: "ヒルズ"}, version: MasterVersion2,
+			want: `"nameJa":"ヒルズ","nameEn":"Hiruzu","nameEnSource":"romanized"`},
+		//英語名がない場合も空のnameEnと出所を出力する
+		{name: "none", spot: SpotInfo{NameJa: "木場公園"}, version: MasterVersion2,
+			want: `"nameJa":"木場公園","nameEn":"","nameEnSource":"none"`},
+		//バージョン1は従来の形式のまま
+		{name: "version 1", spot: SpotInfo{NameJa: "木場公園"}, version: 1,
+			want: `"name":"木場公園","lat":"","lon":""}`},
+	}
+	for _, tt := range tests {
+		b, err := json.Marshal(tt.spot.InnerMaster().Versioned(tt.version))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(b), tt.want) {
+			t.Errorf("%s : %s, want %s", tt.name, b, tt.want)
+		}
+	}
+}
+
+func TestSignedRequest(t *testing.T) {
+	ok := func(w rest.ResponseWriter, r *rest.Request) {
+		//署名の確認で読み込んだBodyもハンドラで読める
+		body, _ := ioutil.ReadAll(r.Body)
+		w.WriteJson(string(body))
+	}
+	api := rest.NewApi()
+	api.Use(&AuthMiddleware{Config: AuthConfig{Keys: []APIKey{{Name: "admin", Key: "secret", Permissions: []string{PermAll}}}}})
+	router, err := rest.MakeRouter(rest.Post("/credentials/:profile", ok))
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.SetApp(router)
+	srv := httptest.NewServer(api.MakeHandler())
+	defer srv.Close()
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	signed := `{"id":"member","password":"new"}`
+	signature := Sign("secret", "POST", "/credentials/default", ts, []byte(signed))
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		//Bodyを書き換えた場合は署名が合わない
+		{name: "tampered body", body: `{"id":"attacker","password":"x"}`, want: http.StatusUnauthorized},
+		{name: "signed", body: signed, want: http.StatusOK},
+		//同じ署名のリクエストの再送は受け付けない
+		{name: "replay", body: signed, want: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("POST", srv.URL+"/credentials/default", strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Key-ID", "admin")
+		req.Header.Set("X-Timestamp", ts)
+		req.Header.Set("X-Signature", signature)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s : status = %d, want %d", tt.name, resp.StatusCode, tt.want)
+		}
+		if tt.want == http.StatusOK && !strings.Contains(string(body), "member") {
+			t.Errorf("%s : body not passed to handler : %s", tt.name, body)
+		}
+	}
+}
+
+func TestMasterDiffLocation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "heroku_scraper_master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewMasterState(filepath.Join(dir, "master.json"))
+	spot := func(lat float64, lon float64, has bool) []SpotInfo {
+		return []SpotInfo{{SpotCode: SpotCode{Area: "H1", Spot: "01"}, NameJa: "木場公園", Lat: lat, Lon: lon, HasLocation: has}}
+	}
+	tests := []struct {
+		name string
+		list []SpotInfo
+		want string
+	}{
+		{name: "baseline", list: spot(35.6727, 139.817, true)},
+		//緯度経度を取得できなかった場合は移動としない
+		{name: "location missing", list: spot(0, 0, false)},
+		{name: "location back", list: spot(35.6727, 139.817, true)},
+		{name: "moved", list: spot(35.68, 139.817, true), want: ChangeRelocated},
+		//取得できなかった後も前回の緯度経度と比べる
+		{name: "missing again", list: spot(0, 0, false)},
+		{name: "moved while missing", list: spot(35.69, 139.817, true), want: ChangeRelocated},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, c := range m.Diff("tokyo", "4", tt.list, nil) {
+			got = append(got, c.Type)
+		}
+		if strings.Join(got, ",") != tt.want {
+			t.Errorf("%s : changes = %v, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAreaCatalogAdoptReorganized(t *testing.T) {
+	dir, err := ioutil.TempDir("", "heroku_scraper_areas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	city, _ := NewConfig().City("")
+	reorganized := []Area{{ID: "20"}, {ID: "21"}, {ID: "22"}, {ID: "1"}}
+	c := NewAreaCatalog(filepath.Join(dir, "areas.json"))
+	tests := []struct {
+		name       string
+		areas      []Area
+		wantSource string
+	}{
+		{name: "first", areas: reorganized, wantSource: "config"},
+		{name: "second", areas: reorganized, wantSource: "config"},
+		//途中で取得できなかった場合は数え直す
+		{name: "not found", areas: nil, wantSource: "config"},
+		{name: "first again", areas: reorganized, wantSource: "config"},
+		{name: "second again", areas: reorganized, wantSource: "config"},
+		//AreaAdoptAfter回続けて同じ一覧なら採用する
+		{name: "third", areas: reorganized, wantSource: "discovered"},
+		{name: "after adopted", areas: reorganized, wantSource: "discovered"},
+	}
+	for _, tt := range tests {
+		if err := c.Update(logger, city, tt.areas); err != nil {
+			t.Fatal(err)
+		}
+		if got := c.Get(city).Source; got != tt.wantSource {
+			t.Errorf("%s : source = %s, want %s", tt.name, got, tt.wantSource)
+		}
+	}
+	if got := c.AreaIDs(city); got != "20,21,22,1" {
+		t.Errorf("areas = %s", got)
+	}
+}
+
+func TestHealthObserveScrape(t *testing.T) {
+	h := NewHealth()
+	h.ObserveScrape("1", nil)
+	tests := []struct {
+		name      string
+		err       error
+		wantState string
+		wantError bool
+	}{
+		{name: "canceled", err: fmt.Errorf("get spots : %w", context.Canceled), wantState: "ok", wantError: false},
+		{name: "timeout", err: fmt.Errorf("get spots : %w", context.DeadlineExceeded), wantState: "ok", wantError: true},
+		{name: "error page", err: errors.New("portal error page"), wantState: "error", wantError: true},
+		{name: "recovered", err: nil, wantState: "ok", wantError: false},
+	}
+	for _, tt := range tests {
+		h.ObserveScrape("1", tt.err)
+		if h.portal.State != tt.wantState {
+			t.Errorf("%s : portal state = %s, want %s", tt.name, h.portal.State, tt.wantState)
+		}
+		if got := h.areas["1"].Error != ""; got != tt.wantError {
+			t.Errorf("%s : area error = %q", tt.name, h.areas["1"].Error)
+		}
+	}
+}
+
+func TestJobHistoryKeepsActive(t *testing.T) {
+	m := NewJobManager(2)
+	running := m.New("counts", "test", "")
+	running.Start()
+	queued := m.New("master", "test", "")
+	done := m.New("recover", "test", "")
+	done.Start()
+	done.Finish(nil)
+	//最大件数を超えても実行中・待機中のジョブは残す
+	m.New("counts", "test", "")
+	for _, j := range []*Job{running, queued} {
+		if m.Get(j.ID()) == nil {
+			t.Errorf("active job %s was dropped", j.ID())
+		}
+	}
+	if m.Get(done.ID()) != nil {
+		t.Errorf("finished job %s was kept", done.ID())
+	}
+	if got := len(m.List()); got != 3 {
+		t.Errorf("jobs = %d, want 3", got)
+	}
+	//終了すれば古いものから捨てる
+	running.Finish(nil)
+	queued.Finish(nil)
+	m.New("counts", "test", "")
+	if got := len(m.List()); got != 2 {
+		t.Errorf("jobs = %d, want 2", got)
+	}
+	if m.Get(running.ID()) != nil || m.Get(queued.ID()) != nil {
+		t.Errorf("finished jobs were kept")
+	}
+}
+
+func TestCSVSinkHeaderMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "heroku_scraper_csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spotinfo.csv")
+	//都市の列を追加する前のファイル
+	old := "time,area,spot,count\n2016/05/01 12:00:00,H1,01,3\n"
+	if err := ioutil.WriteFile(path, []byte(old), 0664); err != nil {
+		t.Fatal(err)
+	}
+	jsondata := JSpotinfo{}
+	jsondata.Add(SpotInfo{SpotCode: SpotCode{Area: "H1", Spot: "01"}, NameJa: "木場公園", Count: 1})
+	sink := CSVSink{Path: path}
+	for i := 0; i < 2; i++ {
+		if err := sink.SendSpotInfo(context.Background(), logger, jsondata); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 3 || lines[0] != "time,area,spot,count,city" {
+		t.Errorf("csv = %q", string(b))
+	}
+	rotated, _ := filepath.Glob(path + ".*")
+	if len(rotated) != 1 {
+		t.Fatalf("rotated = %v", rotated)
+	}
+	if b, _ := ioutil.ReadFile(rotated[0]); string(b) != old {
+		t.Errorf("rotated csv = %q", string(b))
+	}
+}
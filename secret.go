@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/ant0ine/go-json-rest/rest"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////
+// 秘密情報
+//////////////////////////////////////////////////////////////////////////////////////
+
+//EncryptedPrefix 暗号化した値の接頭辞
+const EncryptedPrefix = "enc:"
+
+//memoryKey メモリ上の秘密情報を暗号化する鍵（起動ごとにランダム）
+var memoryKey = randomKey()
+
+//Secret パスワードなどの秘密情報（メモリ上でも暗号化して保持し、ログやJSONには出力しない）
+type Secret struct {
+	sealed []byte
+}
+
+//randomKey ランダムな鍵を作成する
+func randomKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+//seal AES-GCMで暗号化する（先頭にnonceを付ける）
+func seal(key []byte, plain []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plain, nil), nil
+}
+
+//unseal AES-GCMで復号する
+func unseal(key []byte, sealed []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+}
+
+//NewSecret 平文から作成する
+func NewSecret(plain string) Secret {
+	if plain == "" {
+		return Secret{}
+	}
+	sealed, err := seal(memoryKey, []byte(plain))
+	if err != nil {
+		panic(err)
+	}
+	return Secret{sealed: sealed}
+}
+
+//Reveal 平文を返す（ポータルや送信先に渡す直前にのみ使う）
+func (s Secret) Reveal() string {
+	if len(s.sealed) == 0 {
+		return ""
+	}
+	plain, err := unseal(memoryKey, s.sealed)
+	if err != nil {
+		panic(err)
+	}
+	return string(plain)
+}
+
+//Empty 空か
+func (s Secret) Empty() bool {
+	return len(s.sealed) == 0
+}
+
+//Equal 同じ値か
+func (s Secret) Equal(other Secret) bool {
+	return subtle.ConstantTimeCompare([]byte(s.Reveal()), []byte(other.Reveal())) == 1
+}
+
+//String ログなどに出力しても平文が出ないようにする
+func (s Secret) String() string {
+	return "***"
+}
+
+//MarshalJSON JSONにも平文を出力しない
+func (s Secret) MarshalJSON() ([]byte, error) {
+	if s.Empty() {
+		return json.Marshal("")
+	}
+	return json.Marshal("***")
+}
+
+//UnmarshalJSON 平文または"enc:"で始まる暗号化した値（環境変数CREDENTIALS_KEYで復号する）を読み込む
+func (s *Secret) UnmarshalJSON(b []byte) error {
+	var val string
+	if err := json.Unmarshal(b, &val); err != nil {
+		return err
+	}
+	if strings.HasPrefix(val, EncryptedPrefix) {
+		plain, err := DecryptCredential(val)
+		if err != nil {
+			return err
+		}
+		val = plain
+	}
+	*s = NewSecret(val)
+	return nil
+}
+
+//credentialKey 保存用の鍵（環境変数CREDENTIALS_KEYのSHA-256）
+func credentialKey() ([]byte, error) {
+	val := os.Getenv("CREDENTIALS_KEY")
+	if val == "" {
+		return nil, fmt.Errorf("CREDENTIALS_KEY is not set")
+	}
+	sum := sha256.Sum256([]byte(val))
+	return sum[:], nil
+}
+
+//EncryptCredential 保存用に暗号化する（"enc:"+Base64）
+func EncryptCredential(plain string) (string, error) {
+	key, err := credentialKey()
+	if err != nil {
+		return "", err
+	}
+	sealed, err := seal(key, []byte(plain))
+	if err != nil {
+		return "", err
+	}
+	return EncryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+//DecryptCredential 保存用に暗号化した値を復号する
+func DecryptCredential(val string) (string, error) {
+	key, err := credentialKey()
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(val, EncryptedPrefix))
+	if err != nil {
+		return "", err
+	}
+	plain, err := unseal(key, sealed)
+	if err != nil {
+		return "", fmt.Errorf("decrypt credential failed (wrong CREDENTIALS_KEY?)")
+	}
+	return string(plain), nil
+}
+
+//////////////////////////////////////////////////////////////////////////////////////
+// 認証情報の保存と更新
+//////////////////////////////////////////////////////////////////////////////////////
+
+//StoredCredential 保存する認証情報（パスワードは暗号化する）
+type StoredCredential struct {
+	ID       string `json:"id"`
+	Password string `json:"password"`
+}
+
+//CredentialStore プロファイルごとの認証情報（再起動しなくても更新できるようにファイルに保存する）
+type CredentialStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+//credentials 認証情報の保存先
+var credentials = &CredentialStore{path: dataPath("CREDENTIALS_PATH", "credentials.json")}
+
+//load 保存済みの認証情報を読み込む（ファイルがなければ空）
+func (s *CredentialStore) load() (map[string]StoredCredential, error) {
+	stored := map[string]StoredCredential{}
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return stored, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &stored); err != nil {
+		return nil, fmt.Errorf("%s : %v", s.path, err)
+	}
+	return stored, nil
+}
+
+//Apply 保存済みの認証情報で設定のプロファイルを上書きする
+func (s *CredentialStore) Apply(c *Config) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, err := s.load()
+	if err != nil {
+		return err
+	}
+	for name, cred := range stored {
+		password, err := DecryptCredential(cred.Password)
+		if err != nil {
+			return fmt.Errorf("credential %s : %v", name, err)
+		}
+		c.SetCredentials(name, cred.ID, NewSecret(password))
+	}
+	return nil
+}
+
+//Rotate 認証情報を暗号化して保存し、設定のプロファイルを更新する
+func (s *CredentialStore) Rotate(c *Config, name string, id string, password string) error {
+	encrypted, err := EncryptCredential(password)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, err := s.load()
+	if err != nil {
+		return err
+	}
+	stored[name] = StoredCredential{ID: id, Password: encrypted}
+	b, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path, b); err != nil {
+		return err
+	}
+	c.SetCredentials(name, id, NewSecret(password))
+	return nil
+}
+
+//RotateCredentials プロファイルのログインIDとパスワードを更新する（Bodyは{"id": "...", "password": "..."}）
+func RotateCredentials(w rest.ResponseWriter, r *rest.Request) {
+	//認証なしでは誰でも書き換えられるため受け付けない
+	if !config.Auth.Enabled() {
+		rest.Error(w, "authentication must be enabled to rotate credentials", http.StatusForbidden)
+		return
+	}
+	name := r.PathParam("profile")
+	var body struct {
+		ID       string `json:"id"`
+		Password string `json:"password"`
+	}
+	if err := r.DecodeJsonPayload(&body); err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body.Password == "" {
+		rest.Error(w, "password is required", http.StatusBadRequest)
+		return
+	}
+	//IDを省略した場合は現在のIDのまま
+	if body.ID == "" {
+		if prof, err := config.Profile(name); err == nil {
+			body.ID = prof.ID
+		}
+	}
+	if body.ID == "" {
+		rest.Error(w, "id is required", http.StatusBadRequest)
+		return
+	}
+	if err := credentials.Rotate(config, name, body.ID, body.Password); err != nil {
+		logger.Error("credential rotation failed", "profile", name, "error", err)
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logger.Info("credentials rotated", "profile", name, "member", body.ID)
+	w.WriteJson(map[string]string{"result": "OK", "profile": name, "id": body.ID})
+}
+
+//EncryptCommand 標準入力の平文を暗号化して設定ファイル用の値を出力する（heroku_scraper encrypt）
+func EncryptCommand() error {
+	b, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+	encrypted, err := EncryptCredential(strings.TrimRight(string(b), "\r\n"))
+	if err != nil {
+		return err
+	}
+	fmt.Println(encrypted)
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////
+// セッション管理
+//////////////////////////////////////////////////////////////////////////////////////
+
+//Session 都市・アカウントごとのログインセッション
+type Session struct {
+	City        City
+	UserID      string
+	password    Secret
+	id          string
+	lastExcuted int64
+	//loggedIn ログイン済みなら1（ログイン中もmuを取らずに読めるようにする）
+	loggedIn int32
+	//mu セッション情報の排他制御
+	mu sync.Mutex
+	//run スクレイピング実行の排他制御（同一アカウントの実行は直列化する）
+	run sync.Mutex
+}
+
+//SessionManager 都市とメンバーIDをキーにセッションを管理する
+type SessionManager struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+//sessions セッション管理（アカウントごとにセッションを使いまわす）
+var sessions = NewSessionManager()
+
+//NewSessionManager セッション管理を作成する
+func NewSessionManager() *SessionManager {
+	return &SessionManager{sessions: map[string]*Session{}}
+}
+
+//Get メンバーIDに対応するセッションを返す。未ログインもしくはパスワードが前回と異なる場合はログインする
+func (m *SessionManager) Get(ctx context.Context, lg Logger, city City, userID string, password Secret) (*Session, error) {
+	s := m.Lookup(city, userID)
+	if err := s.Login(ctx, lg, password); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+//Lookup メンバーIDに対応するセッションを返す（ログインはしない。なければ未ログインのセッションを作成する）
+func (m *SessionManager) Lookup(city City, userID string) *Session {
+	key := cityKey(city.Name, userID)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, exist := m.sessions[key]
+	if !exist {
+		s = &Session{City: city, UserID: userID}
+		m.sessions[key] = s
+	}
+	return s
+}
+
+//Login 未ログインもしくはパスワードが前回と異なる場合はログインする
+func (s *Session) Login(ctx context.Context, lg Logger, password Secret) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.id != "" && s.password.Equal(password) {
+		return nil
+	}
+	//前回ログイン情報と異なる場合はログインし直し（失敗した場合は既存のセッションを壊さない）
+	id, err := GetSessionID(ctx, lg, s.City, s.UserID, password)
+	if err != nil {
+		return err
+	}
+	s.password = password
+	s.setID(id)
+	return nil
+}
+
+//Count ログイン済みのセッション数（ログイン中のセッションのロックは待たない）
+func (m *SessionManager) Count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	count := 0
+	for _, s := range m.sessions {
+		if s.LoggedIn() {
+			count++
+		}
+	}
+	return count
+}
+
+//LoggedIn ログイン済みか
+func (s *Session) LoggedIn() bool {
+	return atomic.LoadInt32(&s.loggedIn) == 1
+}
+
+//setID セッションIDを更新する（ロックは呼び出し元で取る）
+func (s *Session) setID(id string) {
+	s.id = id
+	if id != "" {
+		atomic.StoreInt32(&s.loggedIn, 1)
+	} else {
+		atomic.StoreInt32(&s.loggedIn, 0)
+	}
+}
+
+//ID 現在のセッションIDを返す
+func (s *Session) ID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.id
+}
+
+//Relogin ログインし直してセッションIDを返す。usedはエラーになったリクエストで使ったセッションID
+func (s *Session) Relogin(ctx context.Context, lg Logger, used string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	//既に他のリクエストでログインし直している場合はそれを使う
+	if s.id != used && s.id != "" {
+		return s.id, nil
+	}
+	id, err := GetSessionID(ctx, lg, s.City, s.UserID, s.password)
+	if err != nil {
+		return "", err
+	}
+	s.setID(id)
+	return id, nil
+}
+
+//CheckInterval 最小間隔（設定のrateLimit.minInterval）以内の連続実行ならfalseを返す。実行可能な場合は最終実行時刻を更新する
+func (s *Session) CheckInterval() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().Unix()
+	if now-s.lastExcuted < int64(time.Duration(config.RateLimit.MinInterval).Seconds()) {
+		return false
+	}
+	s.lastExcuted = now
+	return true
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////
+// 終了処理
+//////////////////////////////////////////////////////////////////////////////////////
+
+//DefaultShutdownTimeout 終了処理の制限時間（HerokuはSIGTERMから30秒で強制終了する）
+const DefaultShutdownTimeout = 25 * time.Second
+
+//shutdownTimeout 終了処理の制限時間（環境変数SHUTDOWN_TIMEOUTで変更できる）
+func shutdownTimeout() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("SHUTDOWN_TIMEOUT")); err == nil && d > 0 {
+		return d
+	}
+	return DefaultShutdownTimeout
+}
+
+//Serve サーバーを起動し、SIGTERMまたはSIGINTを受けたら終了処理をしてから戻る
+//新しいリクエストと定期実行を止め、実行中のジョブをキャンセルする（未送信のデータはスプールに保存される）
+func Serve(srv *http.Server) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	select {
+	case err := <-errc:
+		return err
+	case s := <-sig:
+		logger.Info("shutdown started", "signal", s.String(), "timeout", shutdownTimeout().String())
+	}
+	signal.Stop(sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout())
+	defer cancel()
+	//定期実行を止める
+	scheduler.Stop()
+	//新しいリクエストを受け付けずに処理中のリクエストを待つ
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Warn("http server shutdown failed", "error", err)
+	}
+	//実行中のジョブをキャンセルして終了を待つ
+	if remaining := jobs.Shutdown(ctx); remaining > 0 {
+		logger.Warn("shutdown timed out", "remaining_jobs", remaining)
+		return nil
+	}
+	logger.Info("shutdown completed")
+	return nil
+}
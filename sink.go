@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////
+// 出力先（シンク）
+//////////////////////////////////////////////////////////////////////////////////////
+
+//DefaultSinks シンク未指定時の出力先
+const DefaultSinks = "http"
+
+//sinkFileLock ファイル出力の排他制御（複数の実行が同じファイルに書き込むため）
+var sinkFileLock = sync.Mutex{}
+
+//Sink 台数情報の出力先
+type Sink interface {
+	//Name シンク名
+	Name() string
+	//SendSpotInfo 台数情報を出力する
+	SendSpotInfo(ctx context.Context, lg Logger, jsonStruct JSpotinfo) error
+}
+
+//HTTPSink コールバックURLにPOSTする（従来の送信方法）
+type HTTPSink struct {
+	Address string
+	//Cert 送信時に付ける証明書（空の場合は設定のapiCert）
+	Cert Secret
+}
+
+//JSONLinesSink JSON Lines形式でファイルに追記する
+type JSONLinesSink struct {
+	Path string
+}
+
+//CSVSink CSV形式でファイルに追記する
+type CSVSink struct {
+	Path string
+}
+
+//StdoutSink 標準出力に出力する
+type StdoutSink struct{}
+
+//Name シンク名
+func (s HTTPSink) Name() string {
+	return "http"
+}
+
+//SendSpotInfo DBに送信する（失敗したらJSONを保存する）
+func (s HTTPSink) SendSpotInfo(ctx context.Context, lg Logger, jsonStruct JSpotinfo) error {
+	return SendSpotInfo(ctx, lg, s.Address, s.Cert, jsonStruct, false)
+}
+
+//Name シンク名
+func (s JSONLinesSink) Name() string {
+	return "jsonl"
+}
+
+//SendSpotInfo 1件1行のJSONでファイルに追記する
+func (s JSONLinesSink) SendSpotInfo(ctx context.Context, lg Logger, jsonStruct JSpotinfo) error {
+	sinkFileLock.Lock()
+	defer sinkFileLock.Unlock()
+	fp, err := os.OpenFile(s.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0664)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	e := json.NewEncoder(fp)
+	for _, info := range jsonStruct.Spotinfo {
+		if err := e.Encode(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Name シンク名
+func (s CSVSink) Name() string {
+	return "csv"
+}
+
+//csvHeader CSVのヘッダ（都市は既存のファイルと列の並びが変わらないように最後の列にする）
+var csvHeader = []string{"time", "area", "spot", "count", "city"}
+
+//SendSpotInfo CSVでファイルに追記する（新規作成時はヘッダを付ける）
+//既存のファイルのヘッダが異なる場合（都市の列を追加する前のファイルなど）は、既存のファイルを退避して新しいファイルに出力する
+func (s CSVSink) SendSpotInfo(ctx context.Context, lg Logger, jsonStruct JSpotinfo) error {
+	sinkFileLock.Lock()
+	defer sinkFileLock.Unlock()
+	header, err := readCSVHeader(s.Path)
+	if err != nil {
+		return err
+	}
+	if header != nil && strings.Join(header, ",") != strings.Join(csvHeader, ",") {
+		rotated := s.Path + "." + time.Now().Format("20060102150405")
+		if err := os.Rename(s.Path, rotated); err != nil {
+			return fmt.Errorf("csv header mismatch (%s) and rotate failed : %v", strings.Join(header, ","), err)
+		}
+		lg.Warn("csv header changed, rotated existing file", "path", s.Path, "rotated", rotated, "header", strings.Join(header, ","))
+		header = nil
+	}
+	fp, err := os.OpenFile(s.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0664)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	w := csv.NewWriter(fp)
+	if header == nil {
+		w.Write(csvHeader)
+	}
+	for _, info := range jsonStruct.Spotinfo {
+		w.Write([]string{info.Time, info.Area, info.Spot, info.Count, info.City})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+//readCSVHeader 既存のファイルのヘッダを返す（ファイルがない・空の場合はnil）
+func readCSVHeader(path string) ([]string, error) {
+	fp, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	r := csv.NewReader(fp)
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	return header, err
+}
+
+//Name シンク名
+func (s StdoutSink) Name() string {
+	return "stdout"
+}
+
+//SendSpotInfo 1件1行のJSONで標準出力に出力する
+func (s StdoutSink) SendSpotInfo(ctx context.Context, lg Logger, jsonStruct JSpotinfo) error {
+	e := json.NewEncoder(os.Stdout)
+	for _, info := range jsonStruct.Spotinfo {
+		if err := e.Encode(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//SinkNames 出力先の指定（指定→環境変数SINKS→デフォルトの順）
+func SinkNames(names string) string {
+	if names == "" {
+		names = os.Getenv("SINKS")
+	}
+	if names == "" {
+		names = DefaultSinks
+	}
+	return names
+}
+
+//NewSinks カンマ区切りのシンク名からシンクを作成する。certはhttpシンクの送信時に付ける証明書
+func NewSinks(names string, address string, cert Secret) ([]Sink, error) {
+	var sinks []Sink
+	for _, name := range strings.Split(names, ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+			continue
+		case "http":
+			if address == "" {
+				return nil, fmt.Errorf("address is required for http sink")
+			}
+			sinks = append(sinks, HTTPSink{Address: address, Cert: cert})
+		case "jsonl":
+			sinks = append(sinks, JSONLinesSink{Path: dataPath("SINK_JSONL_PATH", "spotinfo.jsonl")})
+		case "csv":
+			sinks = append(sinks, CSVSink{Path: dataPath("SINK_CSV_PATH", "spotinfo.csv")})
+		case "stdout":
+			sinks = append(sinks, StdoutSink{})
+		default:
+			return nil, fmt.Errorf("unknown sink : %s", name)
+		}
+	}
+	if len(sinks) == 0 {
+		return nil, fmt.Errorf("no sink specified")
+	}
+	return sinks, nil
+}
+
+//SendToSinks 全シンクに並行して出力する。1つのシンクが失敗しても他のシンクには出力する
+//シンクごとの結果はジョブに記録する。失敗してもスプールに保存できた場合はエラーにしない
+func SendToSinks(ctx context.Context, lg Logger, job *Job, areaID string, sinks []Sink, jsonStruct JSpotinfo) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(sinks))
+	for i, sink := range sinks {
+		wg.Add(1)
+		go func(i int, sink Sink) {
+			defer wg.Done()
+			err := sink.SendSpotInfo(ctx, lg.With("sink", sink.Name()), jsonStruct)
+			job.AddDelivery(NewDeliveryResult(areaID, sink.Name(), jsonStruct.Size(), err))
+			var spooled *SpooledError
+			if err != nil && !errors.As(err, &spooled) {
+				lg.Error("sink output failed", "sink", sink.Name(), "error", err)
+				errs[i] = fmt.Errorf("%s : %v", sink.Name(), err)
+			}
+		}(i, sink)
+	}
+	wg.Wait()
+	var msgs []string
+	for _, err := range errs {
+		if err != nil {
+			msgs = append(msgs, err.Error())
+		}
+	}
+	if len(msgs) > 0 {
+		return fmt.Errorf("%s", strings.Join(msgs, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////
+// 差分送信
+//////////////////////////////////////////////////////////////////////////////////////
+
+//送信モード
+const (
+	//ModeFull 毎回全スポットを送信する
+	ModeFull = "full"
+	//ModeDelta 前回から台数が変わったスポットのみ送信する（定期的に全件送信する）
+	ModeDelta = "delta"
+)
+
+//DefaultFullInterval 差分送信モードで全件送信する間隔
+const DefaultFullInterval = time.Hour
+
+//Snapshot 送信先ごとの最終送信台数（再起動しても引き継ぐためファイルに保存する）
+type Snapshot struct {
+	mu      sync.Mutex
+	path    string
+	Targets map[string]*SnapshotTarget `json:"targets"`
+}
+
+//SnapshotTarget 送信先ごとの状態
+type SnapshotTarget struct {
+	//Counts "エリア-スポット"ごとの台数
+	Counts map[string]string `json:"counts"`
+	//LastFull エリアIDごとの最終全件送信時刻
+	LastFull map[string]string `json:"lastFull"`
+}
+
+//snapshot 最終送信台数
+var snapshot = NewSnapshot(dataPath("SNAPSHOT_PATH", "snapshot.json"))
+
+//fullInterval 全件送信する間隔（環境変数DELTA_FULL_INTERVALで指定する。例："30m"）
+func fullInterval() time.Duration {
+	if val, err := time.ParseDuration(os.Getenv("DELTA_FULL_INTERVAL")); err == nil && val > 0 {
+		return val
+	}
+	return DefaultFullInterval
+}
+
+//NewSnapshot ファイルから読み込んで作成する（ファイルがなければ空）
+func NewSnapshot(path string) *Snapshot {
+	s := &Snapshot{path: path, Targets: map[string]*SnapshotTarget{}}
+	fp, err := os.Open(path)
+	if err != nil {
+		return s
+	}
+	defer fp.Close()
+	if err := json.NewDecoder(fp).Decode(s); err != nil {
+		logger.Error("snapshot decode failed", "path", path, "error", err)
+		s.Targets = map[string]*SnapshotTarget{}
+	}
+	return s
+}
+
+//ModeName 送信モードの指定（指定→環境変数DELIVERY_MODE→fullの順）
+func ModeName(mode string) (string, error) {
+	if mode == "" {
+		mode = os.Getenv("DELIVERY_MODE")
+	}
+	switch mode {
+	case "":
+		return ModeFull, nil
+	case ModeFull, ModeDelta:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown mode : %s", mode)
+}
+
+//SnapshotKey 送信先を識別するキー（出力先とコールバックURLの組み合わせ。東京以外は都市ごとに分ける）
+func SnapshotKey(p RunParam) string {
+	var names []string
+	for _, sink := range p.Sinks {
+		names = append(names, sink.Name())
+	}
+	return cityKey(p.City.Name, strings.Join(names, ",")+"|"+p.SendAddress)
+}
+
+//Filter 送信するスポットと全件送信かを返す。差分送信モードでは台数が変わったスポットのみ返すが、
+//全件送信の間隔を過ぎた場合は全件返す。最終送信台数は送信後にCommitで更新する
+func (s *Snapshot) Filter(key string, areaID string, mode string, list []SpotInfo) ([]SpotInfo, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	target := s.Targets[key]
+	if target == nil {
+		target = &SnapshotTarget{}
+	}
+	full := mode != ModeDelta
+	if last, err := time.ParseInLocation(TimeLayout, target.LastFull[areaID], time.Local); err != nil || time.Since(last) >= fullInterval() {
+		full = true
+	}
+	var result []SpotInfo
+	for _, info := range list {
+		if prev, exist := target.Counts[info.Code()]; full || !exist || prev != strconv.Itoa(info.Count) {
+			result = append(result, info)
+		}
+	}
+	return result, full
+}
+
+//Commit 送信できた（またはスプールに保存した）スポットの最終送信台数を更新する
+//fullは全件送信をすべて送信できた場合のみtrueにする（失敗した場合は次回も全件送信する）
+func (s *Snapshot) Commit(key string, areaID string, sent []SpotInfo, full bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	target, exist := s.Targets[key]
+	if !exist {
+		target = &SnapshotTarget{Counts: map[string]string{}, LastFull: map[string]string{}}
+		s.Targets[key] = target
+	}
+	for _, info := range sent {
+		target.Counts[info.Code()] = strconv.Itoa(info.Count)
+	}
+	if full {
+		target.LastFull[areaID] = time.Now().Format(TimeLayout)
+	}
+}
+
+//Save ファイルに保存する（一時ファイルからリネームする）
+func (s *Snapshot) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, b)
+}
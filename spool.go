@@ -0,0 +1,588 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ant0ine/go-json-rest/rest"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////
+// リカバリ用スプール
+//////////////////////////////////////////////////////////////////////////////////////
+
+//スプールのエントリ状態（フォルダ名）
+const (
+	SpoolPending = "pending"
+	SpoolDead    = "dead"
+)
+
+//SpoolRetryBase 再送間隔の初期値（失敗するたびに倍にする）
+const SpoolRetryBase = time.Minute
+
+//SpoolRetryMax 再送間隔の上限
+const SpoolRetryMax = time.Hour
+
+//スプールのデータ種別
+const (
+	SpoolTypeSpotinfo      = "spotinfo"
+	SpoolTypeSpotmaster    = "spotmaster"
+	SpoolTypeMasterchanges = "masterchanges"
+)
+
+//spoolIDPattern エントリIDの形式（パスに使うため）
+var spoolIDPattern = regexp.MustCompile(`^[0-9]+-[0-9a-f]+$`)
+
+//SpoolEntry 送信に失敗したデータと再送情報
+type SpoolEntry struct {
+	ID    string `json:"id"`
+	State string `json:"state"`
+	//Type データ種別（spotinfo, spotmaster, masterchanges）
+	Type      string          `json:"type"`
+	Address   string          `json:"address"`
+	CreatedAt string          `json:"createdAt"`
+	Attempts  int             `json:"attempts"`
+	LastError string          `json:"lastError"`
+	NextRetry string          `json:"nextRetry"`
+	Payload   json.RawMessage `json:"payload"`
+	//Cert 送信時の証明書（設定のapiCertと異なる場合のみ。CREDENTIALS_KEYで暗号化する）
+	Cert string `json:"cert,omitempty"`
+}
+
+//SpoolSummary エントリの概要（一覧用）
+type SpoolSummary struct {
+	ID        string `json:"id"`
+	State     string `json:"state"`
+	Type      string `json:"type"`
+	CreatedAt string `json:"createdAt"`
+	Attempts  int    `json:"attempts"`
+	LastError string `json:"lastError"`
+	NextRetry string `json:"nextRetry"`
+	Count     int    `json:"count"`
+}
+
+//Spool スプール（<dir>/pending と <dir>/dead に1エントリ1ファイルで保存する）
+type Spool struct {
+	dir         string
+	maxAttempts int
+	mu          sync.Mutex
+	//sending 送信中のエントリID（送信中はロックを取らないため、同じエントリを重ねて送信しないようにする）
+	sending map[string]bool
+}
+
+//spool リカバリ用スプール
+var spool = NewSpool(dataPath("SPOOL_DIR", "spool"), spoolMaxAttempts())
+
+//spoolMaxAttempts デッドレターに移すまでの送信回数
+func spoolMaxAttempts() int {
+	if val, err := strconv.Atoi(os.Getenv("SPOOL_MAX_ATTEMPTS")); err == nil && val > 0 {
+		return val
+	}
+	return 10
+}
+
+//NewSpool スプールを作成する
+func NewSpool(dir string, maxAttempts int) *Spool {
+	return &Spool{dir: dir, maxAttempts: maxAttempts, sending: map[string]bool{}}
+}
+
+//path エントリのファイルパス
+func (s *Spool) path(state string, id string) string {
+	return filepath.Join(s.dir, state, id+".json")
+}
+
+//write エントリを一時ファイルに書いてからリネームする（書きかけのファイルを残さない）
+func (s *Spool) write(e *SpoolEntry) error {
+	dir := filepath.Join(s.dir, e.State)
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return err
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path(e.State, e.ID), b)
+}
+
+//read エントリを読み込む
+func (s *Spool) read(state string, id string) (*SpoolEntry, error) {
+	fp, err := os.Open(s.path(state, id))
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	var e SpoolEntry
+	if err := json.NewDecoder(fp).Decode(&e); err != nil {
+		return nil, err
+	}
+	e.State = state
+	//種別のない古いエントリは台数情報
+	if e.Type == "" {
+		e.Type = SpoolTypeSpotinfo
+	}
+	return &e, nil
+}
+
+//find 状態を問わずエントリを探す
+func (s *Spool) find(id string) (*SpoolEntry, error) {
+	if !spoolIDPattern.MatchString(id) {
+		return nil, os.ErrNotExist
+	}
+	e, err := s.read(SpoolPending, id)
+	if os.IsNotExist(err) {
+		return s.read(SpoolDead, id)
+	}
+	return e, err
+}
+
+//list 状態ごとのエントリを古い順に返す
+func (s *Spool) list(state string) []*SpoolEntry {
+	files, err := filepath.Glob(filepath.Join(s.dir, state, "*.json"))
+	if err != nil {
+		logger.Error("spool list failed", "state", state, "error", err)
+		return nil
+	}
+	sort.Strings(files)
+	var result []*SpoolEntry
+	for _, file := range files {
+		id := filepath.Base(file)
+		id = id[:len(id)-len(".json")]
+		e, err := s.read(state, id)
+		if err != nil {
+			logger.Error("spool read failed", "file", file, "error", err)
+			continue
+		}
+		result = append(result, e)
+	}
+	return result
+}
+
+//Put 送信に失敗したデータ（JSpotinfoまたはJSpotmaster）を保存してエントリIDを返す
+func (s *Spool) Put(address string, cert Secret, dataType string, payload interface{}, lastError error) (string, error) {
+	marshalized, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, 4)
+	rand.Read(b)
+	now := time.Now()
+	e := &SpoolEntry{
+		ID:        strconv.FormatInt(now.UnixNano(), 10) + "-" + hex.EncodeToString(b),
+		State:     SpoolPending,
+		Type:      dataType,
+		Address:   address,
+		CreatedAt: now.Format(TimeLayout),
+		Attempts:  1,
+		NextRetry: now.Add(SpoolRetryBase).Format(TimeLayout),
+		Payload:   marshalized,
+	}
+	if lastError != nil {
+		e.LastError = lastError.Error()
+	}
+	//実行ごとの証明書は暗号化して保存する（保存できない場合は再送時に設定のapiCertを使う）
+	if !cert.Empty() && !cert.Equal(config.APICert) {
+		if e.Cert, err = EncryptCredential(cert.Reveal()); err != nil {
+			logger.Warn("spool cert not saved", "spool", e.ID, "error", err)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.write(e); err != nil {
+		logger.Error("spool put failed", "spool", e.ID, "error", err)
+		return "", err
+	}
+	return e.ID, nil
+}
+
+//claim 送信中にする。既に送信中の場合はfalseを返す（ロックは呼び出し元で取る）
+func (s *Spool) claim(e *SpoolEntry) bool {
+	if s.sending[e.ID] {
+		return false
+	}
+	s.sending[e.ID] = true
+	return true
+}
+
+//send claim済みのエントリを送信して結果に応じて削除・再送予約・デッドレター移動する
+//送信中はロックを取らない（送信先が応答しない間もPutや一覧を止めないため）
+func (s *Spool) send(job *Job, e *SpoolEntry) error {
+	address := e.Address
+	if address == "" {
+		address = SendAddress
+	}
+	lg := job.Logger().With("spool", e.ID, "attempts", e.Attempts)
+	err := e.deliver(job.Context(), lg, address, e.cert(lg))
+	result := NewDeliveryResult("", "http", e.Size(), err)
+	result.File = e.ID
+	job.AddDelivery(result)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sending, e.ID)
+	old := s.path(e.State, e.ID)
+	if err == nil {
+		lg.Info("recover succeeded")
+		metrics.LastSuccess.SetToNow("recover")
+		if rerr := os.Remove(old); rerr != nil && !os.IsNotExist(rerr) {
+			return rerr
+		}
+		return nil
+	}
+	//キャンセルされた場合（終了時など）は送信回数も再送時刻も変えない
+	if job.Context().Err() != nil || errors.Is(err, context.Canceled) {
+		lg.Info("recover canceled", "error", err)
+		return err
+	}
+	lg.Warn("recover failed", "error", err)
+	//送信中に削除された場合は書き戻さない
+	if _, serr := os.Stat(old); os.IsNotExist(serr) {
+		return err
+	}
+	//失敗するたびに再送間隔を倍にする
+	e.Attempts++
+	e.LastError = err.Error()
+	backoff := SpoolRetryBase << uint(e.Attempts-1)
+	if backoff > SpoolRetryMax || backoff <= 0 {
+		backoff = SpoolRetryMax
+	}
+	e.NextRetry = time.Now().Add(backoff).Format(TimeLayout)
+	if e.State == SpoolPending && e.Attempts >= s.maxAttempts {
+		lg.Error("moved to dead letter", "attempts", e.Attempts)
+		e.State = SpoolDead
+	}
+	if werr := s.write(e); werr != nil {
+		return werr
+	}
+	if old != s.path(e.State, e.ID) {
+		os.Remove(old)
+	}
+	return err
+}
+
+//deliver データ種別に応じた送信を行う（失敗してもスプールには保存し直さない）
+func (e *SpoolEntry) deliver(ctx context.Context, lg Logger, address string, cert Secret) error {
+	switch e.Type {
+	case SpoolTypeSpotmaster:
+		var payload JSpotmaster
+		if err := json.Unmarshal(e.Payload, &payload); err != nil {
+			return err
+		}
+		return SendSpotMaster(ctx, lg, address, cert, payload, true)
+	case SpoolTypeMasterchanges:
+		var payload JMasterChanges
+		if err := json.Unmarshal(e.Payload, &payload); err != nil {
+			return err
+		}
+		return SendMasterChanges(ctx, lg, address, cert, payload, true)
+	default:
+		var payload JSpotinfo
+		if err := json.Unmarshal(e.Payload, &payload); err != nil {
+			return err
+		}
+		return SendSpotInfo(ctx, lg, address, cert, payload, true)
+	}
+}
+
+//cert 保存した証明書を復号する（保存していない・復号できない場合は空にして設定のapiCertを使う）
+func (e *SpoolEntry) cert(lg Logger) Secret {
+	if e.Cert == "" {
+		return Secret{}
+	}
+	plain, err := DecryptCredential(e.Cert)
+	if err != nil {
+		lg.Warn("spool cert not restored", "error", err)
+		return Secret{}
+	}
+	return NewSecret(plain)
+}
+
+//Size 送信データの件数
+func (e *SpoolEntry) Size() int {
+	var payload map[string][]json.RawMessage
+	if err := json.Unmarshal(e.Payload, &payload); err != nil {
+		return 0
+	}
+	size := 0
+	for _, list := range payload {
+		size += len(list)
+	}
+	return size
+}
+
+//Drain 再送時刻を過ぎたエントリを最大max件送信する。forceがtrueなら再送時刻を待たない
+//対象のエントリはロックを取って選び、送信はロックを外して行う
+func (s *Spool) Drain(job *Job, max int, force bool) {
+	job.Start()
+	s.sendClaimed(job, s.claimTargets(max, force))
+}
+
+//claimTargets 再送時刻を過ぎたエントリを最大max件選んで送信中にする。forceがtrueなら再送時刻を待たない
+func (s *Spool) claimTargets(max int, force bool) []*SpoolEntry {
+	var targets []*SpoolEntry
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.list(SpoolPending) {
+		if len(targets) >= max {
+			break
+		}
+		if !force && !s.due(e) {
+			continue
+		}
+		if s.claim(e) {
+			targets = append(targets, e)
+		}
+	}
+	return targets
+}
+
+//sendClaimed claim済みのエントリを送信してジョブを終了する
+func (s *Spool) sendClaimed(job *Job, targets []*SpoolEntry) {
+	for i, e := range targets {
+		//キャンセルされた場合は残りを次回に回す（再送回数は増やさない）
+		if job.Context().Err() != nil {
+			s.release(targets[i:])
+			break
+		}
+		s.send(job, e)
+	}
+	job.Finish(nil)
+}
+
+//release 送信しなかったエントリを送信中から外す
+func (s *Spool) release(list []*SpoolEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range list {
+		delete(s.sending, e.ID)
+	}
+}
+
+//due 再送時刻を過ぎているか
+func (s *Spool) due(e *SpoolEntry) bool {
+	next, err := time.ParseInLocation(TimeLayout, e.NextRetry, time.Local)
+	return err != nil || !next.After(time.Now())
+}
+
+//Retry 指定エントリをすぐに送信する（デッドレターの場合は回数をリセットして戻す）
+func (s *Spool) Retry(job *Job, id string) (*SpoolEntry, error) {
+	e, err := s.prepareRetry(id)
+	if err != nil {
+		job.Finish(err)
+		return nil, err
+	}
+	job.Start()
+	err = s.send(job, e)
+	job.Finish(err)
+	return e, err
+}
+
+//prepareRetry 再送するエントリを送信中にする（デッドレターの場合は回数をリセットして戻す）
+func (s *Spool) prepareRetry(id string) (*SpoolEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, err := s.find(id)
+	if err != nil {
+		return nil, err
+	}
+	if !s.claim(e) {
+		return nil, fmt.Errorf("spool entry is being sent : %s", id)
+	}
+	if e.State == SpoolDead {
+		old := s.path(e.State, e.ID)
+		e.State = SpoolPending
+		e.Attempts = 0
+		if err := s.write(e); err != nil {
+			delete(s.sending, e.ID)
+			return nil, err
+		}
+		os.Remove(old)
+	}
+	return e, nil
+}
+
+//Remove 指定エントリを削除する
+func (s *Spool) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, err := s.find(id)
+	if err != nil {
+		return err
+	}
+	return os.Remove(s.path(e.State, e.ID))
+}
+
+//Purge 指定状態のエントリをすべて削除して件数を返す
+func (s *Spool) Purge(state string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := 0
+	for _, e := range s.list(state) {
+		if err := os.Remove(s.path(e.State, e.ID)); err == nil {
+			count++
+		}
+	}
+	return count
+}
+
+//Summary 状態ごとのエントリ概要を返す
+func (s *Spool) Summary() map[string][]SpoolSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := map[string][]SpoolSummary{}
+	for _, state := range []string{SpoolPending, SpoolDead} {
+		result[state] = []SpoolSummary{}
+		for _, e := range s.list(state) {
+			result[state] = append(result[state], SpoolSummary{
+				ID:        e.ID,
+				State:     e.State,
+				Type:      e.Type,
+				CreatedAt: e.CreatedAt,
+				Attempts:  e.Attempts,
+				LastError: e.LastError,
+				NextRetry: e.NextRetry,
+				Count:     e.Size(),
+			})
+		}
+	}
+	return result
+}
+
+//Depth 状態ごとのエントリ数
+func (s *Spool) Depth(state string) int {
+	files, _ := filepath.Glob(filepath.Join(s.dir, state, "*.json"))
+	return len(files)
+}
+
+//ImportLegacy 旧形式の一時ファイル（/tmp/<unix>_save.json）をスプールに取り込む
+func (s *Spool) ImportLegacy() {
+	files, err := filepath.Glob(dataPath("", "*_save.json"))
+	if err != nil {
+		logger.Error("legacy import failed", "error", err)
+		return
+	}
+	for _, path := range files {
+		fp, err := os.Open(path)
+		if err != nil {
+			logger.Error("legacy file open failed", "file", path, "error", err)
+			continue
+		}
+		var payload JSpotinfo
+		err = json.NewDecoder(fp).Decode(&payload)
+		fp.Close()
+		if err != nil && err != io.EOF {
+			logger.Error("legacy file decode failed", "file", path, "error", err)
+			continue
+		}
+		if _, err := s.Put(os.Getenv("SEND_ADDRESS"), Secret{}, SpoolTypeSpotinfo, payload, nil); err != nil {
+			continue
+		}
+		os.Remove(path)
+		logger.Info("legacy file imported to spool", "file", path)
+	}
+}
+
+//StartDrainer バックグラウンドで定期的に再送する
+func (s *Spool) StartDrainer(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			//送信に必要な情報がそろうまでは再送しない
+			if initialized() {
+				s.drainDue(20)
+			}
+		}
+	}()
+}
+
+//drainDue 再送時刻を過ぎたエントリを最大max件送信する
+//送信するエントリがない場合（他の再送で送信中の場合を含む）はジョブを作らずnilを返す（ジョブの履歴を埋めないため）
+func (s *Spool) drainDue(max int) *Job {
+	targets := s.claimTargets(max, false)
+	if len(targets) == 0 {
+		return nil
+	}
+	job := jobs.New("recover", "spool", "")
+	job.Start()
+	s.sendClaimed(job, targets)
+	return job
+}
+
+//initialized 送信に必要な設定（API証明書）が済んでいるか
+func initialized() bool {
+	return lastExcuted > 0 || !config.APICert.Empty()
+}
+
+//GetSpool スプールの一覧を返す
+func GetSpool(w rest.ResponseWriter, r *rest.Request) {
+	w.WriteJson(spool.Summary())
+}
+
+//GetSpoolEntry スプールのエントリを返す
+func GetSpoolEntry(w rest.ResponseWriter, r *rest.Request) {
+	spool.mu.Lock()
+	e, err := spool.find(r.PathParam("id"))
+	spool.mu.Unlock()
+	if err != nil {
+		rest.NotFound(w, r)
+		return
+	}
+	w.WriteJson(e)
+}
+
+//RetrySpoolEntry スプールのエントリをすぐに再送する
+func RetrySpoolEntry(w rest.ResponseWriter, r *rest.Request) {
+	spool.mu.Lock()
+	_, err := spool.find(r.PathParam("id"))
+	spool.mu.Unlock()
+	if err != nil {
+		rest.NotFound(w, r)
+		return
+	}
+	job := jobs.New("recover", "api", "")
+	e, err := spool.Retry(job, r.PathParam("id"))
+	result := map[string]string{"result": "OK", "job": job.ID()}
+	if err != nil {
+		result["result"] = err.Error()
+	}
+	if e != nil {
+		result["state"] = e.State
+	}
+	w.WriteHeader(http.StatusOK)
+	w.WriteJson(result)
+}
+
+//DeleteSpoolEntry スプールのエントリを削除する
+func DeleteSpoolEntry(w rest.ResponseWriter, r *rest.Request) {
+	if err := spool.Remove(r.PathParam("id")); err != nil {
+		rest.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.WriteJson("OK")
+}
+
+//PurgeSpool 指定状態（state=dead|pending、省略時はdead）のエントリをすべて削除する
+func PurgeSpool(w rest.ResponseWriter, r *rest.Request) {
+	state := r.URL.Query().Get("state")
+	if state == "" {
+		state = SpoolDead
+	}
+	if state != SpoolDead && state != SpoolPending {
+		rest.Error(w, "invalid state", http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.WriteJson(map[string]int{"purged": spool.Purge(state)})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////
+// スポット情報
+//////////////////////////////////////////////////////////////////////////////////////
+
+//MaxSpotCount 台数として受け付ける上限（送信先の桁数に合わせる）
+const MaxSpotCount = 999
+
+//MaxSpotErrors ジョブごとに保持する検証エラーの最大件数（件数はすべて数える）
+const MaxSpotErrors = 100
+
+//spotCodePattern エリアコード・スポットコードとして受け付ける形式（送信先の桁数に合わせて3文字まで）
+var spotCodePattern = regexp.MustCompile(`^[0-9A-Za-z]{1,3}$`)
+
+//SpotCode スポットコード（"H1-43"の"H1"がエリア、"43"がスポット）
+type SpotCode struct {
+	Area string
+	Spot string
+}
+
+//ParseSpotCode "H1-43"の形式のテキストからスポットコードを取得する
+func ParseSpotCode(text string) (SpotCode, error) {
+	arr := strings.Split(text, "-")
+	if len(arr) != 2 {
+		return SpotCode{}, fmt.Errorf("unexpected spot code : %s", text)
+	}
+	return SpotCode{Area: arr[0], Spot: arr[1]}, nil
+}
+
+//Code "H1-43"の形式（スポットの重複判定や前回値のキーに使う）
+func (c SpotCode) Code() string {
+	return c.Area + "-" + c.Spot
+}
+
+//英語名の出所
+const (
+	//NameEnPortal ポータルの英語名
+	NameEnPortal = "portal"
+	//NameEnRomanized ポータルに英語名がないため日本語名をローマ字にしたもの
+	NameEnRomanized = "romanized"
+	//NameEnNone ポータルに英語名がなく、日本語名もローマ字にできない（漢字を含むなど）ため英語名は空
+	NameEnNone = "none"
+)
+
+//SpotInfo スクレイピング結果を格納する構造体
+type SpotInfo struct {
+	Time time.Time
+	City string
+	SpotCode
+	//NameJa 日本語名, NameEn 英語名（一覧にない場合は空）
+	NameJa string
+	NameEn string
+	Count  int
+	Lat    float64
+	Lon    float64
+	//HasLocation 緯度経度を取得できたか
+	HasLocation bool
+}
+
+//SpotError スポット情報の検証エラー
+type SpotError struct {
+	Area   string `json:"area,omitempty"`
+	Spot   string `json:"spot,omitempty"`
+	Field  string `json:"field"`
+	Value  string `json:"value"`
+	Reason string `json:"reason"`
+}
+
+//Error エラーメッセージ
+func (e SpotError) Error() string {
+	return fmt.Sprintf("spot %s-%s : %s %s : %q", e.Area, e.Spot, e.Field, e.Reason, e.Value)
+}
+
+//SetLocation 緯度経度のテキストを設定する。数値にできない場合は検証エラーを返す
+func (s *SpotInfo) SetLocation(lat string, lon string) []SpotError {
+	var errs []SpotError
+	flat, err := strconv.ParseFloat(strings.TrimSpace(lat), 64)
+	if err != nil {
+		errs = append(errs, s.fieldError("lat", lat, "not a number"))
+	}
+	flon, err := strconv.ParseFloat(strings.TrimSpace(lon), 64)
+	if err != nil {
+		errs = append(errs, s.fieldError("lon", lon, "not a number"))
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	s.Lat, s.Lon, s.HasLocation = flat, flon, true
+	return nil
+}
+
+//Validate 送信できる値か検証する。問題があればすべての項目の検証エラーを返す
+func (s SpotInfo) Validate() []SpotError {
+	var errs []SpotError
+	if !spotCodePattern.MatchString(s.Area) {
+		errs = append(errs, s.fieldError("area", s.Area, "invalid code"))
+	}
+	if !spotCodePattern.MatchString(s.Spot) {
+		errs = append(errs, s.fieldError("spot", s.Spot, "invalid code"))
+	}
+	if strings.TrimSpace(s.NameJa) == "" {
+		errs = append(errs, s.fieldError("name", s.NameJa, "empty"))
+	}
+	if s.Count < 0 || s.Count > MaxSpotCount {
+		errs = append(errs, s.fieldError("count", strconv.Itoa(s.Count), "out of range"))
+	}
+	if s.HasLocation {
+		if s.Lat < -90 || s.Lat > 90 {
+			errs = append(errs, s.fieldError("lat", formatCoord(s.Lat), "out of range"))
+		}
+		if s.Lon < -180 || s.Lon > 180 {
+			errs = append(errs, s.fieldError("lon", formatCoord(s.Lon), "out of range"))
+		}
+	}
+	return errs
+}
+
+//fieldError スポットの項目の検証エラー
+func (s SpotInfo) fieldError(field string, value string, reason string) SpotError {
+	return SpotError{Area: s.Area, Spot: s.Spot, Field: field, Value: value, Reason: reason}
+}
+
+//Inner 従来の文字列の形式（台数情報）に変換する
+func (s SpotInfo) Inner() InnerSpotinfo {
+	return InnerSpotinfo{Time: s.Time.Format(TimeLayout), City: s.City, Area: s.Area, Spot: s.Spot, Count: strconv.Itoa(s.Count)}
+}
+
+//EnglishName 英語名と出所を返す。ポータルに英語名がない場合は日本語名をローマ字にする
+//ローマ字にできるのは仮名と英数字のみで、漢字を含む場合は空の英語名とNameEnNoneを返す
+func (s SpotInfo) EnglishName() (string, string) {
+	if s.NameEn != "" {
+		return s.NameEn, NameEnPortal
+	}
+	if name, ok := Romanize(s.NameJa); ok && name != "" {
+		return name, NameEnRomanized
+	}
+	return "", NameEnNone
+}
+
+//InnerMaster 文字列の形式（スポット情報）に変換する。緯度経度を取得できなかった場合は空文字
+//日本語名・英語名も含めるので、送信時はバージョンに合わせてVersionedで絞る
+func (s SpotInfo) InnerMaster() InnerSpotmaster {
+	master := InnerSpotmaster{City: s.City, Area: s.Area, Spot: s.Spot, Name: s.NameJa, NameJa: s.NameJa}
+	master.NameEn, master.NameEnSource = s.EnglishName()
+	if s.HasLocation {
+		master.Lat = formatCoord(s.Lat)
+		master.Lon = formatCoord(s.Lon)
+	}
+	return master
+}
+
+//formatCoord 緯度経度を文字列にする（元の桁数のまま、末尾の0は付けない）
+func formatCoord(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/ant0ine/go-json-rest/rest"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////
+// 台数履歴ストア
+//////////////////////////////////////////////////////////////////////////////////////
+
+//StoreDateLayout 日付フォルダのフォーマット
+const StoreDateLayout = "20060102"
+
+//MaxHistoryDays 履歴検索で一度に取得できる最大日数
+const MaxHistoryDays = 31
+
+//codePattern エリアコード・スポットコードとして許可する文字（パスに使うため）
+var codePattern = regexp.MustCompile(`^[0-9A-Za-z]{1,8}$`)
+
+//SpotStore ファイルベースの台数履歴ストア
+//<dir>/<yyyymmdd>/<area>_<spot>.jsonl に1観測1行で追記する
+type SpotStore struct {
+	dir string
+	mu  sync.RWMutex
+}
+
+//store 台数履歴ストア
+var store = NewSpotStore(dataPath("STORE_DIR", "spotstore"))
+
+//NewSpotStore 台数履歴ストアを作成する
+func NewSpotStore(dir string) *SpotStore {
+	return &SpotStore{dir: dir}
+}
+
+//path 日付・スポットごとのファイルパス（東京以外は都市ごとのフォルダに分ける）
+func (s *SpotStore) path(day time.Time, city string, area string, spot string) string {
+	dir := filepath.Join(s.dir, day.Format(StoreDateLayout))
+	if city != "" && city != DefaultCity {
+		dir = filepath.Join(dir, city)
+	}
+	return filepath.Join(dir, area+"_"+spot+".jsonl")
+}
+
+//Save スクレイピング結果を保存する
+func (s *SpotStore) Save(list []SpotInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, info := range list {
+		if !codePattern.MatchString(info.Area) || !codePattern.MatchString(info.Spot) {
+			logger.Warn("history save skipped (invalid code)", "area", info.Area, "spot", info.Spot)
+			continue
+		}
+		path := s.path(info.Time, info.City, info.Area, info.Spot)
+		if err := os.MkdirAll(filepath.Dir(path), 0775); err != nil {
+			return err
+		}
+		fp, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0664)
+		if err != nil {
+			return err
+		}
+		err = json.NewEncoder(fp).Encode(info.Inner())
+		fp.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//History 指定期間（from以上to以下）の台数履歴を古い順に返す
+func (s *SpotStore) History(city string, area string, spot string, from time.Time, to time.Time) (JSpotinfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	result := JSpotinfo{Spotinfo: []InnerSpotinfo{}}
+	start := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.Local)
+	for day := start; !day.After(to); day = day.AddDate(0, 0, 1) {
+		fp, err := os.Open(s.path(day, city, area, spot))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return result, err
+		}
+		scanner := bufio.NewScanner(fp)
+		for scanner.Scan() {
+			var info InnerSpotinfo
+			if err := json.Unmarshal(scanner.Bytes(), &info); err != nil {
+				continue
+			}
+			t, err := time.ParseInLocation(TimeLayout, info.Time, time.Local)
+			if err != nil || t.Before(from) || t.After(to) {
+				continue
+			}
+			//都市を記録する前の履歴
+			if info.City == "" {
+				info.City = city
+			}
+			result.Spotinfo = append(result.Spotinfo, info)
+		}
+		fp.Close()
+	}
+	return result, nil
+}
+
+//ParseQueryTime 検索条件の時刻を解析する（TimeLayout、日付のみ、RFC3339を受け付ける）
+func ParseQueryTime(value string) (time.Time, error) {
+	for _, layout := range []string{TimeLayout, "2006/01/02", "2006-01-02", time.RFC3339} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time : %s", value)
+}
+
+//GetSpotHistory スポットの台数履歴を返す（cityで都市を指定する。省略時はtokyo）
+func GetSpotHistory(w rest.ResponseWriter, r *rest.Request) {
+	area := r.PathParam("area")
+	spot := r.PathParam("spot")
+	if !codePattern.MatchString(area) || !codePattern.MatchString(spot) {
+		rest.Error(w, "invalid area or spot", http.StatusBadRequest)
+		return
+	}
+	params := r.URL.Query()
+	city, err := config.City(params.Get("city"))
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	//期間（省略時は直近24時間）
+	to := time.Now()
+	if val := params.Get("to"); val != "" {
+		t, err := ParseQueryTime(val)
+		if err != nil {
+			rest.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		to = t
+	}
+	from := to.Add(-24 * time.Hour)
+	if val := params.Get("from"); val != "" {
+		t, err := ParseQueryTime(val)
+		if err != nil {
+			rest.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		from = t
+	}
+	if from.After(to) || to.Sub(from) > MaxHistoryDays*24*time.Hour {
+		rest.Error(w, fmt.Sprintf("period must be within %d days", MaxHistoryDays), http.StatusBadRequest)
+		return
+	}
+	history, err := store.History(city.Name, area, spot, from, to)
+	if err != nil {
+		logger.Error("history read failed", "area", area, "spot", spot, "error", err)
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteJson(history)
+}